@@ -2,30 +2,130 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
+	"github.com/pinative/k8s-bot/controller"
 	"github.com/pinative/k8s-bot/observer"
+	"github.com/pinative/k8s-bot/pkg/config"
+	"github.com/pinative/k8s-bot/pkg/gc"
 	"github.com/pinative/k8s-bot/pkg/helper"
+	"github.com/pinative/k8s-bot/pkg/ingress"
+	"github.com/pinative/k8s-bot/pkg/policy"
+	"github.com/pinative/k8s-bot/pkg/signals"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/sync/errgroup"
 	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/informers"
 	"os"
 )
 
 func main() {
-	helper.LoadEnvVariables()
-
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	runtime.ErrorHandlers = []func(error){
 		func(err error) { log.Warn().Err(err).Msg("[k8s]") },
 	}
 
-	o := observer.New(helper.GetClientset())
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		runGC(os.Args[2:])
+		return
+	}
+
+	loader, err := config.NewLoader(flag.NewFlagSet("k8s-bot", flag.ExitOnError), os.Args[1:])
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+	cfg, err := loader.Load()
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid configuration")
+	}
+	logConfig(cfg)
+
+	o := observer.New(cfg, loader, helper.GetClientset(), helper.GetDynamicClient())
+
+	// Cancel on SIGTERM so the leader lease is released for a standby replica.
+	ctx, cancel := context.WithCancel(context.Background())
+	stopCh := signals.SetupSignalHandler()
+	go func() {
+		<-stopCh
+		cancel()
+	}()
 
 	var eg errgroup.Group
 	eg.Go(func() error {
-		return o.Run(context.TODO())
+		return o.Run(ctx)
 	})
 	if err := eg.Wait(); err != nil {
 		log.Fatal().Err(err).Send()
 	}
-}
\ No newline at end of file
+}
+
+// runGC collects the orphan services and ingresses once, usage:
+//
+//	k8s-bot gc [--dry-run] [flags]
+func runGC(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only print the orphan services and ingresses which would be deleted")
+	cfg, err := config.Load(fs, args)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid configuration")
+	}
+
+	client := helper.GetClientset()
+	iv, err := ingress.DetectAPIVersion(client)
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+
+	policies := policy.NewStore(cfg)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	nc := controller.NewNamespaceController(informers.NewSharedInformerFactory(client, 0), policies, nil)
+	if err := nc.Sync(stopCh); err != nil {
+		log.Fatal().Err(err).Send()
+	}
+	if served, err := policy.Served(client.Discovery()); err != nil {
+		log.Fatal().Err(err).Send()
+	} else if served {
+		if err := policies.Load(helper.GetDynamicClient()); err != nil {
+			log.Fatal().Err(err).Send()
+		}
+	}
+
+	collector := &gc.Collector{
+		K8sClient:      client,
+		DryRun:         *dryRun,
+		IngressVersion: iv,
+		Policies:       policies,
+	}
+	orphans, err := collector.Collect()
+	for _, o := range orphans {
+		if *dryRun {
+			fmt.Printf("%s %s/%s would be deleted\n", o.Kind, o.Namespace, o.Name)
+		} else {
+			fmt.Printf("%s %s/%s deleted\n", o.Kind, o.Namespace, o.Name)
+		}
+	}
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+}
+
+// logConfig prints the effective configuration and where each value came
+// from.
+func logConfig(cfg *config.Config) {
+	for _, v := range cfg.Values() {
+		src := string(v.Source)
+		switch v.Source {
+		case config.SourceEnv:
+			src += " " + v.Env
+		case config.SourceEnvFile:
+			src += " " + v.Env
+		case config.SourceFile:
+			src += " " + cfg.File
+		case config.SourceFlag:
+			src += " --" + v.Flag
+		}
+		log.Info().Str("value", v.Value).Str("source", src).Msg(v.Flag)
+	}
+}
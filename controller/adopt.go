@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pinative/k8s-bot/pkg/ingress"
+	"github.com/pinative/k8s-bot/pkg/policy"
+	"github.com/pinative/k8s-bot/pkg/service"
+	"github.com/rs/zerolog/log"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+)
+
+// AdoptOrphans stamps the owner references on the services and ingresses
+// created by former versions of the bot, so the garbage collector removes
+// them along with their deployment even while the bot is down.
+func AdoptOrphans(client kubernetes.Interface, informerFactory, ingressFactory informers.SharedInformerFactory, v ingress.APIVersion, policies *policy.Store) error {
+	svcLister := informerFactory.Core().V1().Services().Lister()
+	deployLister := informerFactory.Apps().V1().Deployments().Lister()
+
+	services, err := svcLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, svc := range services {
+		conf := policies.Config(svc.Namespace)
+		if !isManaged(policies, svc) || !strings.HasPrefix(svc.Name, conf.ServicePrefix) || metav1.GetControllerOf(svc) != nil {
+			continue
+		}
+		d, err := deployLister.Deployments(svc.Namespace).Get(conf.WorkloadName(svc.Name))
+		if k8serrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		patch, err := ownerReferencesPatch(svc.OwnerReferences, *service.NewOwnerReference(d))
+		if err != nil {
+			return err
+		}
+		_, err = client.CoreV1().Services(svc.Namespace).Patch(context.TODO(), svc.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+		if err != nil {
+			return err
+		}
+		log.Printf("SERVICE %s/%s was ADOPTED by deployment %s", svc.Namespace, svc.Name, d.Name)
+	}
+
+	ingresses, err := ingress.NewLister(ingressFactory, v).List("")
+	if err != nil {
+		return err
+	}
+	for _, ing := range ingresses {
+		if metav1.GetControllerOf(ing) != nil || len(ing.Spec.Rules) == 0 || ing.Spec.Rules[0].HTTP == nil ||
+			len(ing.Spec.Rules[0].HTTP.Paths) == 0 || ing.Spec.Rules[0].HTTP.Paths[0].Backend.Service == nil {
+			continue
+		}
+		sn := ing.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name
+		svc, err := svcLister.Services(ing.Namespace).Get(sn)
+		if k8serrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !isManaged(policies, svc) || ing.Name != policies.Config(ing.Namespace).IngressName(sn) {
+			continue
+		}
+
+		patch, err := ownerReferencesPatch(ing.OwnerReferences, *ingress.NewOwnerReference(svc))
+		if err != nil {
+			return err
+		}
+		ic := &ingress.Client{K8sClient: client, Version: v}
+		err = ic.Patch(ing.Namespace, ing.Name, types.MergePatchType, patch)
+		if err != nil {
+			return err
+		}
+		log.Printf("INGRESS %s/%s was ADOPTED by service %s", ing.Namespace, ing.Name, svc.Name)
+	}
+
+	return nil
+}
+
+// isManaged returns true if the object is managed by the bot.
+func isManaged(policies *policy.Store, obj metav1.Object) bool {
+	return !isExcludedNamespace(policies, obj.GetNamespace()) &&
+		obj.GetAnnotations()["pigo.io/part-of"] == policies.Config(obj.GetNamespace()).PartOf
+}
+
+func ownerReferencesPatch(refs []metav1.OwnerReference, owner metav1.OwnerReference) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"ownerReferences": append(refs, owner),
+		},
+	})
+}
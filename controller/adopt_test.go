@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"context"
+	"github.com/pinative/k8s-bot/pkg/ingress"
+	"github.com/pinative/k8s-bot/pkg/policy"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestAdoptOrphans(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fd := newFakeDeployment()
+	fd.UID = "fake-deploy-uid"
+	fs := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        testConfig.ServicePrefix + fd.Name,
+			Namespace:   fd.Namespace,
+			Annotations: map[string]string{"pigo.io/part-of": testConfig.PartOf},
+		},
+	}
+	client := fake.NewSimpleClientset(fd, fs)
+	isf := informers.NewSharedInformerFactory(client, 0)
+	dc := NewDeploymentController(client, isf, policy.NewStore(testConfig))
+	sc := NewServiceController(client, isf, isf, ingress.NetworkingV1, policy.NewStore(testConfig))
+
+	_ = dc.Sync(ctx.Done())
+	_ = sc.Sync(ctx.Done())
+
+	if err := AdoptOrphans(client, isf, isf, ingress.NetworkingV1, policy.NewStore(testConfig)); err != nil {
+		t.Errorf("Expected no errors occured to adopt the orphans, but got error: %v", err)
+	}
+
+	svc, err := client.CoreV1().Services(fs.Namespace).Get(context.TODO(), fs.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("Expected no errors to get the service %s, but got error: %v", fs.Name, err)
+		return
+	}
+
+	if ref := metav1.GetControllerOf(svc); ref == nil || ref.UID != fd.UID {
+		t.Errorf("Expected the service %s to be owned by the deployment %s, but got %v", fs.Name, fd.Name, ref)
+	}
+}
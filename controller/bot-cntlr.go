@@ -1,13 +1,186 @@
 package controller
 
-var (
-	ExcludesNamespaceList = []string{ "kube-system", "ingress-nginx", "kube-public", "monitor" }
+import (
+	"fmt"
+	"github.com/pinative/k8s-bot/pkg/metrics"
+	"github.com/pinative/k8s-bot/pkg/policy"
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"sync"
+	"time"
 )
 
+// isExcludedNamespace returns true if the bot stays out of the namespace ns,
+// either from its configuration or from the ClusterExposurePolicies.
+func isExcludedNamespace(policies *policy.Store, ns string) bool {
+	return policies.IsExcluded(ns)
+}
+
 type BotController interface {
 	Sync(stopCh <-chan struct{}) error
-	Run(stopCh <-chan struct{})
+	Run(workers int, stopCh <-chan struct{})
 	onAddFunc(obj interface{})
 	onUpdateFunc(old, new interface{})
 	onDeleteFunc(obj interface{})
 }
+
+// newRecorder returns an event recorder writing the events of the bot into
+// the cluster.
+func newRecorder(client kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "k8s-bot"})
+}
+
+// newQueue returns a rate limited workqueue which requeues failed keys
+// with an exponential backoff.
+func newQueue(name string) workqueue.RateLimitingInterface {
+	return workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), name)
+}
+
+// enqueue adds the namespace/name key of the object into the queue.
+func enqueue(queue workqueue.RateLimitingInterface, obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	queue.Add(key)
+}
+
+// countResync counts the update of the informer name which delivers the
+// object unchanged, as the periodic resync does.
+func countResync(name string, old, new interface{}) {
+	o, err := meta.Accessor(old)
+	if err != nil {
+		return
+	}
+	n, err := meta.Accessor(new)
+	if err != nil {
+		return
+	}
+	if o.GetResourceVersion() == n.GetResourceVersion() {
+		metrics.Resyncs.WithLabelValues(name).Inc()
+	}
+}
+
+// A resyncer enqueues every object it manages in the namespace ns, in every
+// namespace when ns is empty.
+type resyncer interface {
+	resync(ns string)
+}
+
+// Resync enqueues every object managed by the controllers in the namespace
+// ns, in every namespace when ns is empty, so a change of their configuration
+// is applied without restarting the bot.
+func Resync(controllers []BotController, ns string) {
+	for _, bc := range controllers {
+		if r, ok := bc.(resyncer); ok {
+			r.resync(ns)
+		}
+	}
+}
+
+// enqueueAll adds the objects of the namespace ns, or of every namespace
+// when ns is empty, out of the excluded namespaces into the queue.
+func enqueueAll(queue workqueue.RateLimitingInterface, policies *policy.Store, ns string, objs []interface{}) {
+	for _, obj := range objs {
+		o, err := meta.Accessor(obj)
+		if err != nil || (ns != "" && o.GetNamespace() != ns) || isExcludedNamespace(policies, o.GetNamespace()) {
+			continue
+		}
+		enqueue(queue, obj)
+	}
+}
+
+// runWorkers starts the given number of workers draining the queue with
+// syncHandler and blocks until stopCh is closed.
+func runWorkers(name string, workers int, queue workqueue.RateLimitingInterface, syncHandler func(key string) error, stopCh <-chan struct{}) {
+	defer runtime.HandleCrash()
+	defer queue.ShutDown()
+
+	log.Info().Str("controller", name).Int("workers", workers).Msg("starting workers")
+	for i := 0; i < workers; i++ {
+		go wait.Until(func() {
+			for processNextItem(name, queue, syncHandler) {
+			}
+		}, time.Second, stopCh)
+	}
+
+	<-stopCh
+	log.Info().Str("controller", name).Msg("shutting down workers")
+}
+
+// inProgress are the keys the workers of every controller are reconciling.
+var inProgress = &progress{started: map[string]time.Time{}}
+
+// progress keeps the time the reconcile of each key in progress was started
+// at, by controller and key.
+type progress struct {
+	mu      sync.Mutex
+	started map[string]time.Time
+}
+
+func (p *progress) track(id string, start time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.started[id] = start
+}
+
+func (p *progress) untrack(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.started, id)
+}
+
+// CheckWorkers returns an error when a worker has been reconciling the same
+// key for longer than timeout, the worker is likely deadlocked.
+func CheckWorkers(timeout time.Duration) error {
+	inProgress.mu.Lock()
+	defer inProgress.mu.Unlock()
+
+	for id, start := range inProgress.started {
+		if d := time.Since(start); d > timeout {
+			return fmt.Errorf("%s has been reconciled for %v", id, d.Round(time.Second))
+		}
+	}
+
+	return nil
+}
+
+// processNextItem reconciles the next key of the queue, it returns false
+// once the queue has been shut down.
+func processNextItem(name string, queue workqueue.RateLimitingInterface, syncHandler func(key string) error) bool {
+	key, quit := queue.Get()
+	if quit {
+		return false
+	}
+	defer queue.Done(key)
+
+	start := time.Now()
+	id := name + " " + key.(string)
+	inProgress.track(id, start)
+	err := syncHandler(key.(string))
+	inProgress.untrack(id)
+	metrics.ObserveReconcile(name, start, err)
+	if err == nil {
+		queue.Forget(key)
+		return true
+	}
+
+	// Requeue the key with backoff so a transient error is never dropped.
+	runtime.HandleError(fmt.Errorf("%s: failed to sync %q (retry %d): %v", name, key, queue.NumRequeues(key), err))
+	queue.AddRateLimited(key)
+
+	return true
+}
@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCheckWorkers(t *testing.T) {
+	queue := newQueue("fake")
+	queue.Add("fake-test/fake-test")
+	processNextItem("fake", queue, func(key string) error {
+		if err := CheckWorkers(time.Minute); err != nil {
+			t.Errorf("Expected the key just started not to be stalled, but got error: %v", err)
+		}
+		return nil
+	})
+	if err := CheckWorkers(0); err != nil {
+		t.Errorf("Expected no key in progress once reconciled, but got error: %v", err)
+	}
+
+	inProgress.track("fake fake-test/stalled", time.Now().Add(-time.Hour))
+	defer inProgress.untrack("fake fake-test/stalled")
+	if err := CheckWorkers(time.Minute); err == nil {
+		t.Errorf("Expected the key reconciled for an hour to be reported as stalled")
+	}
+}
+
+func TestProcessNextItemWithError(t *testing.T) {
+	queue := newQueue("fake")
+	defer queue.ShutDown()
+	key := "fake-test/fake-test"
+	queue.Add(key)
+
+	calls := 0
+	syncHandler := func(k string) error {
+		calls++
+		if calls == 1 {
+			return errors.New("fake error")
+		}
+		return nil
+	}
+
+	processNextItem("fake", queue, syncHandler)
+	if n := queue.NumRequeues(key); n != 1 {
+		t.Errorf("Expected the failed key to be requeued once, but got %d requeues", n)
+	}
+
+	// The key is delivered again once its backoff has elapsed
+	done := make(chan struct{})
+	go func() {
+		processNextItem("fake", queue, syncHandler)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the failed key to be delivered again")
+		return
+	}
+	if calls != 2 {
+		t.Errorf("Expected the key to be reconciled twice, but got %d", calls)
+	}
+	if n := queue.NumRequeues(key); n != 0 {
+		t.Errorf("Expected the key to be forgotten once reconciled, but got %d requeues", n)
+	}
+}
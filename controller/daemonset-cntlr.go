@@ -0,0 +1,33 @@
+package controller
+
+import (
+	"github.com/pinative/k8s-bot/pkg/policy"
+	"github.com/pinative/k8s-bot/pkg/service"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+)
+
+// A DaemonSetController is the workload controller of the daemonsets.
+type DaemonSetController struct {
+	*workloadController
+}
+
+// NewDaemonSetController manages the services of the daemonsets.
+func NewDaemonSetController(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, policies *policy.Store) *DaemonSetController {
+	dsInformer := informerFactory.Apps().V1().DaemonSets()
+
+	get := func(ns, name string) (*service.Workload, metav1.Object, error) {
+		ds, err := dsInformer.Lister().DaemonSets(ns).Get(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return service.DaemonSetWorkload(ds), ds, nil
+	}
+	reconcile := func(svc *service.Service, obj metav1.Object) error {
+		return svc.ReconcileDaemonSet(informerFactory, obj.(*appsv1.DaemonSet))
+	}
+
+	return &DaemonSetController{newWorkloadController("DaemonSet", client, informerFactory, dsInformer.Informer(), policies, get, reconcile)}
+}
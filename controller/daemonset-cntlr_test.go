@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"context"
+	"github.com/pinative/k8s-bot/pkg/policy"
+	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func newFakeDaemonSet() *v1.DaemonSet {
+	return &v1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "fake-ds-name",
+			Namespace: "fake-test",
+			Labels: map[string]string{"app": "fake-ds-name"},
+			Annotations: map[string]string{
+				"pigo.io/part-of": testConfig.PartOf,
+				"pigo.network/internal-traffic-policy": "Local",
+			},
+		},
+		Spec: v1.DaemonSetSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "main", Ports: []corev1.ContainerPort{{Name: "metrics", ContainerPort: int32(9100)}}},
+					},
+				},
+			},
+		},
+		Status: v1.DaemonSetStatus{
+			NumberAvailable: 1,
+		},
+	}
+}
+
+func TestDaemonSetController_SyncDaemonSet(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fd := newFakeDaemonSet()
+	client := fake.NewSimpleClientset(fd)
+	isf := informers.NewSharedInformerFactory(client, 0)
+	dc := NewDaemonSetController(client, isf, policy.NewStore(testConfig))
+
+	_ = dc.Sync(ctx.Done())
+
+	key := fd.Namespace + "/" + fd.Name
+	if err := dc.syncWorkload(key); err != nil {
+		t.Errorf("Expected no errors occured to sync daemonset %s, but got error: %v", key, err)
+	}
+
+	svcName := testConfig.ServicePrefix + fd.Name
+	svc, err := client.CoreV1().Services(fd.Namespace).Get(context.TODO(), svcName, metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("Expected the service %s to be created, but got error: %v", svcName, err)
+		return
+	}
+
+	if p := svc.Spec.InternalTrafficPolicy; p == nil || *p != corev1.ServiceInternalTrafficPolicyLocal {
+		t.Errorf("Expected the internal traffic policy to be Local, but got %v", p)
+	}
+
+	if ref := metav1.GetControllerOf(svc); ref == nil || ref.Kind != "DaemonSet" || ref.Name != fd.Name {
+		t.Errorf("Expected the service to be owned by the daemonset %s, but got %v", fd.Name, ref)
+	}
+}
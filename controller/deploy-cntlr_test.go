@@ -2,19 +2,33 @@ package controller
 
 import (
 	"context"
+	"github.com/pinative/k8s-bot/pkg/config"
+	"github.com/pinative/k8s-bot/pkg/policy"
 	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
 	"testing"
 )
 
+var testConfig = &config.Config{PartOf: "k8s.bot", ServicePrefix: "svc-", IngressPrefix: "ing-", Domain: ".apps.example.com", HostnameStrategy: "template", Workers: 2}
+
 func newFakeDeployment() *v1.Deployment {
 	return &v1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: "fake-deploy-name",
 			Namespace: "fake-test",
 		},
+		Spec: v1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "main", Ports: []corev1.ContainerPort{{ContainerPort: int32(8080)}}},
+					},
+				},
+			},
+		},
 	}
 }
 
@@ -25,11 +39,11 @@ func TestDeploymentController_Sync(t *testing.T) {
 	fd := newFakeDeployment()
 	client := fake.NewSimpleClientset(fd)
 	isf := informers.NewSharedInformerFactory(client, 0)
-	dc := NewDeploymentController(isf)
+	dc := NewDeploymentController(client, isf, policy.NewStore(testConfig))
 
 	_ = dc.Sync(ctx.Done())
 
-	d, err := dc.deploymentInformer.Lister().Deployments(fd.Namespace).Get(fd.Name)
+	d, err := isf.Apps().V1().Deployments().Lister().Deployments(fd.Namespace).Get(fd.Name)
 	if err != nil {
 		t.Errorf("Expected no errors occured to list deployment %s from informer lister, but got error: %v", fd.Name, err)
 	}
@@ -38,3 +52,70 @@ func TestDeploymentController_Sync(t *testing.T) {
 		t.Errorf("Expected returns a deployment, but no deployment returned")
 	}
 }
+
+func TestDeploymentController_SyncDeployment(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fd := newFakeDeployment()
+	fd.Labels = map[string]string{"app": "fake-deploy-name"}
+	fd.Annotations = map[string]string{"pigo.io/part-of": testConfig.PartOf}
+	fd.Status.AvailableReplicas = 1
+	client := fake.NewSimpleClientset(fd)
+	isf := informers.NewSharedInformerFactory(client, 0)
+	dc := NewDeploymentController(client, isf, policy.NewStore(testConfig))
+
+	_ = dc.Sync(ctx.Done())
+
+	key := fd.Namespace + "/" + fd.Name
+	if err := dc.syncWorkload(key); err != nil {
+		t.Errorf("Expected no errors occured to sync deployment %s, but got error: %v", key, err)
+	}
+
+	svcName := testConfig.ServicePrefix + fd.Name
+	if _, err := client.CoreV1().Services(fd.Namespace).Get(context.TODO(), svcName, metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected the service %s to be created, but got error: %v", svcName, err)
+	}
+}
+
+func TestDeploymentController_SyncDeletedDeployment(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fd := newFakeDeployment()
+	fd.Labels = map[string]string{"app": "fake-deploy-name"}
+	fd.Annotations = map[string]string{"pigo.io/part-of": testConfig.PartOf}
+	fd.Status.AvailableReplicas = 1
+	// A service of the user selecting the same pods
+	bystander := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "fake-deploy-name-metrics", Namespace: fd.Namespace, Labels: fd.Labels}}
+	client := fake.NewSimpleClientset(fd, bystander)
+	isf := informers.NewSharedInformerFactory(client, 0)
+	dc := NewDeploymentController(client, isf, policy.NewStore(testConfig))
+
+	_ = dc.Sync(ctx.Done())
+
+	key := fd.Namespace + "/" + fd.Name
+	if err := dc.syncWorkload(key); err != nil {
+		t.Errorf("Expected no errors occured to sync deployment %s, but got error: %v", key, err)
+		return
+	}
+	_ = client.AppsV1().Deployments(fd.Namespace).Delete(context.TODO(), fd.Name, metav1.DeleteOptions{})
+	_ = dc.informer.GetStore().Delete(fd)
+
+	if err := dc.syncWorkload(key); err != nil {
+		t.Errorf("Expected no errors occured to sync the deleted deployment %s, but got error: %v", key, err)
+	}
+
+	// The service of the deployment is left to the garbage collector of the cluster
+	svc, err := client.CoreV1().Services(fd.Namespace).Get(context.TODO(), testConfig.ServiceName(fd.Name), metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("Expected the service to be left to the garbage collector, but got error: %v", err)
+		return
+	}
+	if ref := metav1.GetControllerOf(svc); ref == nil || ref.Kind != "Deployment" || ref.Name != fd.Name {
+		t.Errorf("Expected the service to be owned by the deployment %s, but got %v", fd.Name, ref)
+	}
+	if _, err := client.CoreV1().Services(fd.Namespace).Get(context.TODO(), bystander.Name, metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected the service %s of the user to be left, but got error: %v", bystander.Name, err)
+	}
+}
@@ -2,17 +2,19 @@ package controller
 
 import (
 	"fmt"
-	"github.com/pinative/k8s-bot/pkg/helper"
+	"github.com/pinative/k8s-bot/pkg/ingress"
+	"github.com/pinative/k8s-bot/pkg/policy"
 	"github.com/rs/zerolog/log"
-	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/client-go/informers"
-	informernetv1beta1 "k8s.io/client-go/informers/networking/v1beta1"
 	"k8s.io/client-go/tools/cache"
 )
 
 type IngressController struct {
 	informerFactory informers.SharedInformerFactory
-	ingressInformer     informernetv1beta1.IngressInformer
+	ingressInformer     cache.SharedIndexInformer
+	ingressLister       ingress.Lister
+	policies *policy.Store
 }
 
 func (c *IngressController) Sync(stopCh <-chan struct{}) error {
@@ -20,63 +22,83 @@ func (c *IngressController) Sync(stopCh <-chan struct{}) error {
 	c.informerFactory.Start(stopCh)
 
 	// wait for the initial synchronization of the local cache.
-	if !cache.WaitForCacheSync(stopCh, c.ingressInformer.Informer().HasSynced) {
+	if !cache.WaitForCacheSync(stopCh, c.ingressInformer.HasSynced) {
 		log.Error().Msg("failed to sync ingress data")
 		return fmt.Errorf("failed to sync ingress data")
 	}
 	return nil
 }
 
-// Run starts shared informers and waits for the shared controller cache to
-//  synchronize.
-func (c *IngressController) Run(stopCh <-chan struct{}) {
-	c.ingressInformer.Informer().Run(stopCh)
+// Run blocks until stopCh is closed, ingresses are only observed so there
+// is no worker to start.
+func (c *IngressController) Run(workers int, stopCh <-chan struct{}) {
+	<-stopCh
 }
 
 func (c *IngressController) onAddFunc(obj interface{}) {
-	ing := obj.(*networkingv1beta1.Ingress)
+	ing, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
 
-	flag := helper.AreNamespaceInExcludesList(ing.Namespace, ExcludesNamespaceList)
+	flag := isExcludedNamespace(c.policies, ing.GetNamespace())
 	if flag {
 		return
 	}
 
-	log.Printf("INGRESS %s/%s was CREATED at %v", ing.Namespace, ing.Name, ing.CreationTimestamp)
+	log.Printf("INGRESS %s/%s was CREATED at %v", ing.GetNamespace(), ing.GetName(), ing.GetCreationTimestamp())
 }
 
 func (c *IngressController) onUpdateFunc(old, new interface{}) {
-	oldIng := old.(*networkingv1beta1.Ingress)
-	newIng := new.(*networkingv1beta1.Ingress)
+	countResync("ingress", old, new)
+
+	oldIng, err := meta.Accessor(old)
+	if err != nil {
+		return
+	}
+	newIng, err := meta.Accessor(new)
+	if err != nil {
+		return
+	}
 
-	flag := helper.AreNamespaceInExcludesList(oldIng.Namespace, ExcludesNamespaceList)
+	flag := isExcludedNamespace(c.policies, oldIng.GetNamespace())
 	if flag {
 		return
 	}
 
-	if oldIng == newIng {
-		log.Printf("INGRESS %s/%s was UPDATED.", oldIng.Namespace, oldIng.Name)
+	if oldIng.GetResourceVersion() != newIng.GetResourceVersion() {
+		log.Printf("INGRESS %s/%s was UPDATED.", newIng.GetNamespace(), newIng.GetName())
 	}
 }
 
 func (c *IngressController) onDeleteFunc(obj interface{}) {
-	ing := obj.(*networkingv1beta1.Ingress)
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	ing, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
 
-	flag := helper.AreNamespaceInExcludesList(ing.Namespace, ExcludesNamespaceList)
+	flag := isExcludedNamespace(c.policies, ing.GetNamespace())
 	if flag {
 		return
 	}
 
-	log.Printf("INGRESS %s/%s was DELETED at %v", ing.Namespace, ing.Name, ing.DeletionTimestamp)
+	log.Printf("INGRESS %s/%s was DELETED at %v", ing.GetNamespace(), ing.GetName(), ing.GetDeletionTimestamp())
 }
 
-func NewIngressController(informerFactory informers.SharedInformerFactory) *IngressController {
-	ingressInformer := informerFactory.Networking().V1beta1().Ingresses()
+// NewIngressController observes the ingresses served with the API version v.
+func NewIngressController(informerFactory informers.SharedInformerFactory, v ingress.APIVersion, policies *policy.Store) *IngressController {
+	ingressInformer := ingress.Informer(informerFactory, v)
 
 	ic := &IngressController{
 		informerFactory:   informerFactory,
 		ingressInformer:   ingressInformer,
+		ingressLister:     ingress.NewLister(informerFactory, v),
+		policies:          policies,
 	}
-	ingressInformer.Informer().AddEventHandler(
+	ingressInformer.AddEventHandler(
 		cache.ResourceEventHandlerFuncs{
 			AddFunc: ic.onAddFunc,
 			UpdateFunc: ic.onUpdateFunc,
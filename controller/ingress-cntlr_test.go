@@ -2,6 +2,9 @@ package controller
 
 import (
 	"context"
+	"github.com/pinative/k8s-bot/pkg/ingress"
+	"github.com/pinative/k8s-bot/pkg/policy"
+	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/api/networking/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/informers"
@@ -18,6 +21,15 @@ func newFakeIngress() *v1beta1.Ingress {
 	}
 }
 
+func newFakeV1Ingress() *networkingv1.Ingress {
+	return &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "fake-ing-name",
+			Namespace: "fake-test",
+		},
+	}
+}
+
 func TestIngressController_Sync(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -25,16 +37,37 @@ func TestIngressController_Sync(t *testing.T) {
 	fi := newFakeIngress()
 	client := fake.NewSimpleClientset(fi)
 	isf := informers.NewSharedInformerFactory(client, 0)
-	dc := NewIngressController(isf)
+	dc := NewIngressController(isf, ingress.NetworkingV1beta1, policy.NewStore(testConfig))
+
+	_ = dc.Sync(ctx.Done())
+
+	d, err := dc.ingressLister.List(fi.Namespace)
+	if err != nil {
+		t.Errorf("Expected no errors occured to list ingress %s from informer lister, but got error: %v", fi.Name, err)
+	}
+
+	if len(d) != 1 || d[0].Name != fi.Name {
+		t.Errorf("Expected returns the ingress %s, but got %v", fi.Name, d)
+	}
+}
+
+func TestIngressController_SyncWithNetworkingV1(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fi := newFakeV1Ingress()
+	client := fake.NewSimpleClientset(fi)
+	isf := informers.NewSharedInformerFactory(client, 0)
+	dc := NewIngressController(isf, ingress.NetworkingV1, policy.NewStore(testConfig))
 
 	_ = dc.Sync(ctx.Done())
 
-	d, err := dc.ingressInformer.Lister().Ingresses(fi.Namespace).Get(fi.Name)
+	d, err := dc.ingressLister.List(fi.Namespace)
 	if err != nil {
 		t.Errorf("Expected no errors occured to list ingress %s from informer lister, but got error: %v", fi.Name, err)
 	}
 
-	if d == nil {
-		t.Errorf("Expected returns a deployment, but no deployment returned")
+	if len(d) != 1 || d[0].Name != fi.Name {
+		t.Errorf("Expected returns the ingress %s, but got %v", fi.Name, d)
 	}
 }
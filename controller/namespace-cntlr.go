@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/pinative/k8s-bot/pkg/policy"
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+type NamespaceController struct {
+	informerFactory   informers.SharedInformerFactory
+	namespaceInformer cache.SharedIndexInformer
+	policies          *policy.Store
+	controllers       []BotController
+}
+
+func (c *NamespaceController) Sync(stopCh <-chan struct{}) error {
+	// Starts all the shared informers that have been created by the factory so far.
+	c.informerFactory.Start(stopCh)
+
+	// wait for the initial synchronization of the local cache.
+	if !cache.WaitForCacheSync(stopCh, c.namespaceInformer.HasSynced) {
+		log.Error().Msg("failed to sync namespace data")
+		return fmt.Errorf("failed to sync namespace data")
+	}
+	return nil
+}
+
+// Run blocks until stopCh is closed, the namespaces are read by the policies
+// from the informer so there is no worker to start.
+func (c *NamespaceController) Run(workers int, stopCh <-chan struct{}) {
+	<-stopCh
+}
+
+func (c *NamespaceController) onAddFunc(obj interface{}) {
+	ns, ok := obj.(*corev1.Namespace)
+	if !ok {
+		return
+	}
+
+	// The namespaces listed at startup are known before the other controllers
+	// sync, a later one may be selected by its labels.
+	if c.namespaceInformer.HasSynced() && !c.policies.IsExcluded(ns.Name) {
+		log.Printf("NAMESPACE %s was CREATED at %v", ns.Name, ns.GetCreationTimestamp())
+		c.checkDefaults(ns)
+		Resync(c.controllers, ns.Name)
+	}
+}
+
+func (c *NamespaceController) onUpdateFunc(old, new interface{}) {
+	countResync("namespace", old, new)
+
+	oldNs, ok := old.(*corev1.Namespace)
+	if !ok {
+		return
+	}
+	newNs, ok := new.(*corev1.Namespace)
+	if !ok {
+		return
+	}
+
+	// The objects of the namespace are managed, or released, once its labels
+	// match the namespace selector, or no longer do. They are reconciled
+	// again with the defaults of its annotations.
+	if !labels.Equals(oldNs.Labels, newNs.Labels) || !policy.EqualNamespaceDefaults(oldNs.Annotations, newNs.Annotations) {
+		log.Printf("NAMESPACE %s was UPDATED", newNs.Name)
+		c.checkDefaults(newNs)
+		Resync(c.controllers, newNs.Name)
+	}
+}
+
+// checkDefaults reports the annotations of the namespace ns which are
+// ignored for resulting in an invalid configuration.
+func (c *NamespaceController) checkDefaults(ns *corev1.Namespace) {
+	if err := policy.ApplyNamespaceDefaults(c.policies.Config(""), ns.Annotations); err != nil {
+		log.Error().Err(err).Str("namespace", ns.Name).Msg("the defaults of the namespace annotations are ignored")
+	}
+}
+
+func (c *NamespaceController) onDeleteFunc(obj interface{}) {}
+
+// NewNamespaceController watches the namespaces for the namespace selector and
+// the namespace defaults of the policies, and resyncs the controllers of a
+// namespace whenever its labels or its defaults change.
+func NewNamespaceController(informerFactory informers.SharedInformerFactory, policies *policy.Store, controllers []BotController) *NamespaceController {
+	namespaceInformer := informerFactory.Core().V1().Namespaces().Informer()
+	policies.SetNamespaces(informerFactory.Core().V1().Namespaces().Lister())
+
+	nc := &NamespaceController{
+		informerFactory:   informerFactory,
+		namespaceInformer: namespaceInformer,
+		policies:          policies,
+		controllers:       controllers,
+	}
+	namespaceInformer.AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			AddFunc:    nc.onAddFunc,
+			UpdateFunc: nc.onUpdateFunc,
+			DeleteFunc: nc.onDeleteFunc,
+		},
+	)
+
+	return nc
+}
@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"context"
+	"github.com/pinative/k8s-bot/pkg/policy"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestNamespaceController_Sync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fd := newFakeDeployment()
+	fn := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: fd.Namespace, ResourceVersion: "1"}}
+	client := fake.NewSimpleClientset(fd, fn)
+	isf := informers.NewSharedInformerFactory(client, 0)
+	dc := NewDeploymentController(client, isf, policy.NewStore(testConfig))
+	_ = dc.Sync(ctx.Done())
+
+	conf := *testConfig
+	conf.NamespaceSelector = "k8s-bot.pigo.io/enabled=true"
+	store := policy.NewStore(&conf)
+	nc := NewNamespaceController(informers.NewSharedInformerFactory(client, 0), store, []BotController{dc})
+
+	if err := nc.Sync(ctx.Done()); err != nil {
+		t.Errorf("Expected no errors occured to sync the namespaces, but got error: %v", err)
+		return
+	}
+
+	if !store.IsExcluded(fd.Namespace) {
+		t.Errorf("Expected the namespace %s without the label to be excluded", fd.Namespace)
+	}
+
+	for dc.queue.Len() > 0 {
+		key, _ := dc.queue.Get()
+		dc.queue.Done(key)
+	}
+	labeled := fn.DeepCopy()
+	labeled.Labels = map[string]string{"k8s-bot.pigo.io/enabled": "true"}
+	labeled.ResourceVersion = "2"
+	nc.onUpdateFunc(fn, labeled)
+
+	// The deployments are enqueued again once the labels change
+	if dc.queue.Len() == 0 {
+		t.Errorf("Expected the deployments to be resynced, but the queue is empty")
+	}
+}
+
+func TestNamespaceController_UpdateWithDefaults(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fd := newFakeDeployment()
+	fn := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: fd.Namespace, ResourceVersion: "1"}}
+	client := fake.NewSimpleClientset(fd, fn)
+	isf := informers.NewSharedInformerFactory(client, 0)
+	store := policy.NewStore(testConfig)
+	dc := NewDeploymentController(client, isf, store)
+	_ = dc.Sync(ctx.Done())
+	nc := NewNamespaceController(informers.NewSharedInformerFactory(client, 0), store, []BotController{dc})
+	_ = nc.Sync(ctx.Done())
+
+	for dc.queue.Len() > 0 {
+		key, _ := dc.queue.Get()
+		dc.queue.Done(key)
+	}
+	annotated := fn.DeepCopy()
+	annotated.Annotations = map[string]string{"pigo.io/description": "fake"}
+	nc.onUpdateFunc(fn, annotated)
+	if dc.queue.Len() != 0 {
+		t.Errorf("Expected the deployments not to be resynced for other annotations, but got %d keys", dc.queue.Len())
+	}
+
+	annotated.Annotations["pigo.network/domain"] = ".team.example.com"
+	nc.onUpdateFunc(fn, annotated)
+	if dc.queue.Len() == 0 {
+		t.Errorf("Expected the deployments to be resynced once the defaults change, but the queue is empty")
+	}
+}
@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/pinative/k8s-bot/pkg/config"
+	"github.com/pinative/k8s-bot/pkg/policy"
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"strings"
+	"time"
+)
+
+type PolicyController struct {
+	informerFactory dynamicinformer.DynamicSharedInformerFactory
+	informers       []cache.SharedIndexInformer
+	store           *policy.Store
+	controllers     []BotController
+	// OnRename is called with the cluster configuration the managed objects
+	// were named after when an applied policy renames them.
+	OnRename func(old *config.Config)
+}
+
+func (c *PolicyController) Sync(stopCh <-chan struct{}) error {
+	// Starts all the shared informers that have been created by the factory so far.
+	c.informerFactory.Start(stopCh)
+
+	// wait for the initial synchronization of the local cache.
+	for _, i := range c.informers {
+		if !cache.WaitForCacheSync(stopCh, i.HasSynced) {
+			log.Error().Msg("failed to sync policy data")
+			return fmt.Errorf("failed to sync policy data")
+		}
+	}
+	return nil
+}
+
+// Run blocks until stopCh is closed, the policies are applied to the store
+// by the event handlers so there is no worker to start.
+func (c *PolicyController) Run(workers int, stopCh <-chan struct{}) {
+	<-stopCh
+}
+
+// apply sets the policy obj into the store, or deletes it, and resyncs the
+// controllers so the change is applied without restarting the bot.
+//
+// Like a reload of the configuration, a policy which renames every managed
+// object is refused unless the configuration allows it.
+func (c *PolicyController) apply(obj interface{}, deleted bool) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			return
+		}
+		if u, ok = tombstone.Obj.(*unstructured.Unstructured); !ok {
+			return
+		}
+	}
+
+	kind := strings.ToUpper(u.GetKind())
+	var spec *policy.Spec
+	if !deleted {
+		var err error
+		if spec, err = policy.FromUnstructured(u); err != nil {
+			log.Error().Err(err).Str("policy", policyKey(u)).Msg("invalid policy")
+			return
+		}
+	}
+	old := c.store.Config("")
+	if conf := c.store.ConfigWithPolicy(u.GetNamespace(), u.GetName(), spec); conf.Renames(old) && !old.AllowRename {
+		log.Error().
+			Str("policy", policyKey(u)).
+			Str("partOf", conf.PartOf).
+			Str("servicePrefix", conf.ServicePrefix).
+			Str("ingressPrefix", conf.IngressPrefix).
+			Msg("the policy renames every managed object, set allowRename to apply it, keeping the current configuration")
+		return
+	}
+
+	if deleted {
+		c.store.Delete(u.GetNamespace(), u.GetName())
+		log.Printf("%s %s was DELETED", kind, policyKey(u))
+	} else {
+		if err := c.store.Set(u.GetNamespace(), u.GetName(), spec); err != nil {
+			log.Error().Err(err).Str("policy", policyKey(u)).Msg("invalid policy")
+			return
+		}
+		log.Printf("%s %s was APPLIED", kind, policyKey(u))
+	}
+
+	Resync(c.controllers, u.GetNamespace())
+
+	if c.store.Config("").Renames(old) && c.OnRename != nil {
+		c.OnRename(old)
+	}
+}
+
+func (c *PolicyController) onAddFunc(obj interface{}) {
+	c.apply(obj, false)
+}
+
+func (c *PolicyController) onUpdateFunc(old, new interface{}) {
+	countResync("policy", old, new)
+	if old.(*unstructured.Unstructured).GetResourceVersion() == new.(*unstructured.Unstructured).GetResourceVersion() {
+		return
+	}
+	c.apply(new, false)
+}
+
+func (c *PolicyController) onDeleteFunc(obj interface{}) {
+	c.apply(obj, true)
+}
+
+func policyKey(u *unstructured.Unstructured) string {
+	if u.GetNamespace() == "" {
+		return u.GetName()
+	}
+	return u.GetNamespace() + "/" + u.GetName()
+}
+
+// NewPolicyController watches the ClusterExposurePolicies and ExposurePolicies
+// into the store and resyncs the controllers whenever they change.
+func NewPolicyController(client dynamic.Interface, resync time.Duration, store *policy.Store, controllers []BotController) *PolicyController {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, resync)
+
+	pc := &PolicyController{
+		informerFactory: factory,
+		store:           store,
+		controllers:     controllers,
+	}
+	for _, r := range []schema.GroupVersionResource{policy.ClusterExposurePolicies, policy.ExposurePolicies} {
+		i := factory.ForResource(r).Informer()
+		i.AddEventHandler(
+			cache.ResourceEventHandlerFuncs{
+				AddFunc:    pc.onAddFunc,
+				UpdateFunc: pc.onUpdateFunc,
+				DeleteFunc: pc.onDeleteFunc,
+			},
+		)
+		pc.informers = append(pc.informers, i)
+	}
+
+	return pc
+}
@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"context"
+	"github.com/pinative/k8s-bot/pkg/config"
+	"github.com/pinative/k8s-bot/pkg/policy"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func newFakePolicy(kind, ns, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": policy.GroupVersion.String(),
+		"kind": kind,
+		"metadata": map[string]interface{}{"name": name, "resourceVersion": "1"},
+		"spec": spec,
+	}}
+	obj.SetNamespace(ns)
+
+	return obj
+}
+
+func TestPolicyController_Sync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fd := newFakeDeployment()
+	client := fake.NewSimpleClientset(fd)
+	isf := informers.NewSharedInformerFactory(client, 0)
+	dc := NewDeploymentController(client, isf, policy.NewStore(testConfig))
+	_ = dc.Sync(ctx.Done())
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			policy.ClusterExposurePolicies: "ClusterExposurePolicyList",
+			policy.ExposurePolicies: "ExposurePolicyList",
+		},
+		newFakePolicy("ClusterExposurePolicy", "", "default", map[string]interface{}{"ingressClass": "traefik"}),
+		newFakePolicy("ExposurePolicy", fd.Namespace, "default", map[string]interface{}{"ingressClass": "haproxy"}),
+	)
+	store := policy.NewStore(testConfig)
+	pc := NewPolicyController(dynamicClient, 0, store, []BotController{dc})
+
+	if err := pc.Sync(ctx.Done()); err != nil {
+		t.Errorf("Expected no errors occured to sync the policies, but got error: %v", err)
+		return
+	}
+
+	if v := store.Config(fd.Namespace).IngressClass; v != "haproxy" {
+		t.Errorf("Expected the ingress class of the namespace haproxy, but got %s", v)
+	}
+	if v := store.Config("fake-other").IngressClass; v != "traefik" {
+		t.Errorf("Expected the ingress class of the cluster traefik, but got %s", v)
+	}
+
+	// The deployments are enqueued again to apply the policies
+	if dc.queue.Len() == 0 {
+		t.Errorf("Expected the deployments to be resynced, but the queue is empty")
+	}
+
+	pc.onDeleteFunc(newFakePolicy("ExposurePolicy", fd.Namespace, "default", nil))
+	if v := store.Config(fd.Namespace).IngressClass; v != "traefik" {
+		t.Errorf("Expected the ingress class of the cluster traefik once the namespace policy is deleted, but got %s", v)
+	}
+}
+
+func TestPolicyController_ApplyWithRename(t *testing.T) {
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			policy.ClusterExposurePolicies: "ClusterExposurePolicyList",
+			policy.ExposurePolicies: "ExposurePolicyList",
+		},
+	)
+	store := policy.NewStore(testConfig)
+	pc := NewPolicyController(dynamicClient, 0, store, nil)
+	var renamed *config.Config
+	pc.OnRename = func(old *config.Config) {
+		renamed = old
+	}
+
+	cep := newFakePolicy("ClusterExposurePolicy", "", "default", map[string]interface{}{"servicePrefix": "bot-"})
+	pc.onAddFunc(cep)
+	if v := store.Config("").ServicePrefix; v != testConfig.ServicePrefix {
+		t.Errorf("Expected the policy renaming the services to be refused, but got the service prefix %s", v)
+	}
+	if renamed != nil {
+		t.Errorf("Expected no migration of the refused policy, but got one from %s", renamed.ServicePrefix)
+	}
+
+	conf := *testConfig
+	conf.AllowRename = true
+	store = policy.NewStore(&conf)
+	pc.store = store
+	pc.onAddFunc(cep)
+	if v := store.Config("").ServicePrefix; v != "bot-" {
+		t.Errorf("Expected the service prefix bot- once the rename is allowed, but got %s", v)
+	}
+	if renamed == nil || renamed.ServicePrefix != testConfig.ServicePrefix {
+		t.Errorf("Expected the migration from the service prefix %s, but got %v", testConfig.ServicePrefix, renamed)
+	}
+}
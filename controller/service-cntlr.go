@@ -2,98 +2,199 @@ package controller
 
 import (
 	"fmt"
-	"github.com/pinative/k8s-bot/pkg/helper"
 	"github.com/pinative/k8s-bot/pkg/ingress"
+	"github.com/pinative/k8s-bot/pkg/policy"
+	"github.com/pinative/k8s-bot/pkg/service"
 	"github.com/rs/zerolog/log"
 	"k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/informers"
 	informersv1 "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
-	"os"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"strings"
 )
 
 type ServiceController struct {
+	client          kubernetes.Interface
 	informerFactory informers.SharedInformerFactory
-	serviceInformer     informersv1.ServiceInformer
+	ingressFactory  informers.SharedInformerFactory
+	serviceInformer informersv1.ServiceInformer
+	queue           workqueue.RateLimitingInterface
+	recorder        record.EventRecorder
+	ingressVersion  ingress.APIVersion
+	workloads       *service.WorkloadListers
+	policies *policy.Store
 }
 
 func (c *ServiceController) Sync(stopCh <-chan struct{}) error {
 	// Starts all the shared informers that have been created by the factory so far.
 	c.informerFactory.Start(stopCh)
+	c.ingressFactory.Start(stopCh)
 
 	// wait for the initial synchronization of the local cache.
-	if !cache.WaitForCacheSync(stopCh, c.serviceInformer.Informer().HasSynced) {
+	if !cache.WaitForCacheSync(stopCh, c.serviceInformer.Informer().HasSynced, ingress.Informer(c.ingressFactory, c.ingressVersion).HasSynced) {
 		log.Error().Msg("failed to sync service data")
 		return fmt.Errorf("failed to sync service data")
 	}
 	return nil
 }
 
-// Run starts shared informers and waits for the shared controller cache to
-//  synchronize.
-func (c *ServiceController) Run(stopCh <-chan struct{}) {
-	c.serviceInformer.Informer().Run(stopCh)
+// Run starts the workers reconciling the queued services and blocks
+// until stopCh is closed.
+func (c *ServiceController) Run(workers int, stopCh <-chan struct{}) {
+	runWorkers("service", workers, c.queue, c.syncService, stopCh)
+}
+
+// syncService reconciles the ingress of the service identified by key
+// with the state found in the listers.
+func (c *ServiceController) syncService(key string) error {
+	ns, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	ing := ingress.Ingress{
+		K8sClient:     c.client,
+		ServiceName:   name,
+		Namespace:     ns,
+		Version:       c.ingressVersion,
+		Config:        c.policies.Config(ns),
+		Lister:        ingress.NewLister(c.ingressFactory, c.ingressVersion),
+		Recorder:      c.recorder,
+		Workloads:     c.workloads,
+	}
+
+	svc, err := c.serviceInformer.Lister().Services(ns).Get(name)
+	if k8serrors.IsNotFound(err) {
+		// The service is gone, remove the ingress still routing to it.
+		ingresses, err := ing.Lister.List(ns)
+		if err != nil {
+			return err
+		}
+		if !ingress.HasIngressExists(name, ingresses) {
+			return nil
+		}
+		err = ing.DeleteIngress()
+		if k8serrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	return ing.UpsertIngress(svc)
+}
+
+// resync enqueues every service so a change of the policies is applied.
+func (c *ServiceController) resync(ns string) {
+	enqueueAll(c.queue, c.policies, ns, c.serviceInformer.Informer().GetStore().List())
 }
 
 func (c *ServiceController) onAddFunc(obj interface{}) {
 	//svc := obj.(metav1.Object)
 	svc := obj.(*v1.Service)
-	flag := helper.AreNamespaceInExcludesList(svc.GetNamespace(), ExcludesNamespaceList)
+	flag := isExcludedNamespace(c.policies, svc.GetNamespace())
 	if flag {
 		return
 	}
 
 	log.Printf("SERVICE %s/%s was CREATED at %v", svc.GetNamespace(), svc.GetName(), svc.GetCreationTimestamp())
-	ing := ingress.Ingress{
-		K8sClient: helper.GetClientset(),
-	}
-	_ = ing.UpsertIngress(svc, nil, c.informerFactory)
+	enqueue(c.queue, svc)
 }
 
 func (c *ServiceController) onUpdateFunc(old, new interface{}) {
+	countResync("service", old, new)
+
 	oldSvc := old.(*v1.Service)
 	newSvc := new.(*v1.Service)
 
-	flag := helper.AreNamespaceInExcludesList(oldSvc.Namespace, ExcludesNamespaceList)
+	flag := isExcludedNamespace(c.policies, oldSvc.Namespace)
 	if flag || newSvc.DeletionTimestamp != nil {
 		return
 	}
 
 	log.Printf("SERVICE %s/%s was UPDATED", newSvc.Namespace, newSvc.Name)
-	ing := ingress.Ingress{
-		K8sClient: helper.GetClientset(),
-	}
-	_ = ing.UpsertIngress(newSvc, oldSvc, c.informerFactory)
+	enqueue(c.queue, newSvc)
 }
 
-
 func (c *ServiceController) onDeleteFunc(obj interface{}) {
-	svc := obj.(*v1.Service)
+	svc, ok := obj.(*v1.Service)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			return
+		}
+		if svc, ok = tombstone.Obj.(*v1.Service); !ok {
+			return
+		}
+	}
 
-	flag := helper.AreNamespaceInExcludesList(svc.Namespace, ExcludesNamespaceList)
+	flag := isExcludedNamespace(c.policies, svc.Namespace)
 	if flag {
 		return
 	}
 
-	if svc.Annotations["pigo.io/part-of"] == os.Getenv("ANNOT_PIGO_IO_PARTOF") &&
+	if svc.Annotations["pigo.io/part-of"] == c.policies.Config(svc.Namespace).PartOf &&
 		svc.Annotations["pigo.network/allow-internet-access"] == "true" {
 
 		log.Printf("SERVICE %s/%s was DELETED at %v", svc.Namespace, svc.Name, svc.DeletionTimestamp)
-		ing := ingress.Ingress{
-			K8sClient:   helper.GetClientset(),
-			ServiceName: svc.Name,
-			Namespace:   svc.Namespace,
+		enqueue(c.queue, svc)
+	}
+}
+
+// onIngressDelete enqueues the service of a deleted ingress, so the ingress is
+// created again for the service when it still exists, e.g. after the service
+// was recreated. The service the ingress is named after under the current
+// prefixes is enqueued as well, the owner may be a service renamed since.
+func (c *ServiceController) onIngressDelete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	ing, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+
+	ref := metav1.GetControllerOf(ing)
+	if ref == nil || ref.Kind != "Service" || ing.GetAnnotations()["pigo.io/part-of"] != c.policies.Config(ing.GetNamespace()).PartOf {
+		return
+	}
+	if isExcludedNamespace(c.policies, ing.GetNamespace()) {
+		return
+	}
+	c.queue.Add(ing.GetNamespace() + "/" + ref.Name)
+	conf := c.policies.Config(ing.GetNamespace())
+	if strings.HasPrefix(ing.GetName(), conf.IngressPrefix) {
+		if sn := conf.ServiceName(strings.TrimPrefix(ing.GetName(), conf.IngressPrefix)); sn != ref.Name {
+			c.queue.Add(ing.GetNamespace() + "/" + sn)
 		}
-		_ = ing.DeleteIngress()
 	}
 }
 
-func NewServiceController(informerFactory informers.SharedInformerFactory) *ServiceController {
+// NewServiceController manages the ingresses of the services with the API
+// version v and the configuration of the policies. The ingresses are cached
+// by ingressFactory, the hosts of the ingresses of every namespace are checked
+// for conflicts.
+func NewServiceController(client kubernetes.Interface, informerFactory, ingressFactory informers.SharedInformerFactory, v ingress.APIVersion, policies *policy.Store) *ServiceController {
 	svcInformer := informerFactory.Core().V1().Services()
 
 	sc := &ServiceController{
+		client:          client,
 		informerFactory: informerFactory,
-		serviceInformer:     svcInformer,
+		ingressFactory:  ingressFactory,
+		serviceInformer: svcInformer,
+		queue:           newQueue("service"),
+		recorder:        newRecorder(client),
+		ingressVersion:  v,
+		workloads:       service.NewWorkloadListers(informerFactory),
+		policies:        policies,
 	}
 	svcInformer.Informer().AddEventHandler(
 		cache.ResourceEventHandlerFuncs{
@@ -102,6 +203,12 @@ func NewServiceController(informerFactory informers.SharedInformerFactory) *Serv
 			DeleteFunc: sc.onDeleteFunc,
 		},
 	)
+	// The ingresses informer backs the lister used by syncService.
+	ingress.Informer(ingressFactory, v).AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			DeleteFunc: sc.onIngressDelete,
+		},
+	)
 
 	return sc
 }
@@ -2,7 +2,10 @@ package controller
 
 import (
 	"context"
+	"github.com/pinative/k8s-bot/pkg/ingress"
+	"github.com/pinative/k8s-bot/pkg/policy"
 	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
@@ -25,7 +28,7 @@ func TestServiceController_Sync(t *testing.T) {
 	fs := newFakeService()
 	client := fake.NewSimpleClientset(fs)
 	isf := informers.NewSharedInformerFactory(client, 0)
-	dc := NewServiceController(isf)
+	dc := NewServiceController(client, isf, isf, ingress.NetworkingV1, policy.NewStore(testConfig))
 
 	_ = dc.Sync(ctx.Done())
 
@@ -38,3 +41,98 @@ func TestServiceController_Sync(t *testing.T) {
 		t.Errorf("Expected returns a deployment, but no deployment returned")
 	}
 }
+
+func TestServiceController_OnIngressDelete(t *testing.T) {
+	fs := newFakeService()
+	fs.UID = "fake-svc-uid"
+	client := fake.NewSimpleClientset(fs)
+	isf := informers.NewSharedInformerFactory(client, 0)
+	sc := NewServiceController(client, isf, isf, ingress.NetworkingV1, policy.NewStore(testConfig))
+
+	fi := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "fake-ing-name",
+			Namespace: fs.Namespace,
+			Annotations: map[string]string{"pigo.io/part-of": testConfig.PartOf},
+			OwnerReferences: []metav1.OwnerReference{*ingress.NewOwnerReference(fs)},
+		},
+	}
+	sc.onIngressDelete(fi)
+
+	if sc.queue.Len() != 1 {
+		t.Errorf("Expected the service of the deleted ingress to be enqueued, but got %d keys", sc.queue.Len())
+		return
+	}
+
+	key, _ := sc.queue.Get()
+	if key != fs.Namespace + "/" + fs.Name {
+		t.Errorf("Expected the key %s/%s to be enqueued, but got %v", fs.Namespace, fs.Name, key)
+	}
+}
+
+func TestServiceController_OnIngressDeleteWithRenamedService(t *testing.T) {
+	fs := newFakeService()
+	fs.Name = "old-fake-renamed"
+	fs.UID = "fake-svc-uid"
+	client := fake.NewSimpleClientset(fs)
+	isf := informers.NewSharedInformerFactory(client, 0)
+	sc := NewServiceController(client, isf, isf, ingress.NetworkingV1, policy.NewStore(testConfig))
+
+	// The ingress is still owned by the service named after a former prefix
+	fi := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: testConfig.IngressPrefix + "fake-renamed",
+			Namespace: fs.Namespace,
+			Annotations: map[string]string{"pigo.io/part-of": testConfig.PartOf},
+			OwnerReferences: []metav1.OwnerReference{*ingress.NewOwnerReference(fs)},
+		},
+	}
+	sc.onIngressDelete(fi)
+
+	if sc.queue.Len() != 2 {
+		t.Errorf("Expected the owner and the current service of the deleted ingress to be enqueued, but got %d keys", sc.queue.Len())
+		return
+	}
+	_, _ = sc.queue.Get()
+	key, _ := sc.queue.Get()
+	if key != fs.Namespace + "/" + testConfig.ServiceName("fake-renamed") {
+		t.Errorf("Expected the key %s/%s to be enqueued, but got %v", fs.Namespace, testConfig.ServiceName("fake-renamed"), key)
+	}
+}
+
+func TestServiceController_SyncServiceWithExcludedHost(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fs := newFakeService()
+	fs.Name = testConfig.ServicePrefix + "grafana"
+	fs.Annotations = map[string]string{"pigo.io/part-of": testConfig.PartOf, "pigo.network/allow-internet-access": "true", "pigo.network/port": "http"}
+	fs.Spec.Ports = []v1.ServicePort{{Name: "http", Port: int32(80)}}
+	// The ingress of a namespace the bot does not manage routes the host
+	prefix := networkingv1.PathTypePrefix
+	fi := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: "grafana", Namespace: "monitor"},
+		Spec: networkingv1.IngressSpec{
+			Rules: []networkingv1.IngressRule{{
+				Host: "grafana.fake-test.apps.example.com",
+				IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+					Paths: []networkingv1.HTTPIngressPath{{Path: "/", PathType: &prefix, Backend: networkingv1.IngressBackend{
+						Service: &networkingv1.IngressServiceBackend{Name: "grafana", Port: networkingv1.ServiceBackendPort{Number: 80}},
+					}}},
+				}},
+			}},
+		},
+	}
+	client := fake.NewSimpleClientset(fs, fi)
+	isf := informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithNamespace(fs.Namespace))
+	sc := NewServiceController(client, isf, informers.NewSharedInformerFactory(client, 0), ingress.NetworkingV1, policy.NewStore(testConfig))
+	if err := sc.Sync(ctx.Done()); err != nil {
+		t.Errorf("Expected no errors occured to sync the services, but got error: %v", err)
+		return
+	}
+
+	err := sc.syncService(fs.Namespace + "/" + fs.Name)
+	if _, ok := err.(*ingress.HostConflictError); !ok {
+		t.Errorf("Expected the host routed in the namespace monitor to conflict, but got %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package controller
+
+import (
+	"github.com/pinative/k8s-bot/pkg/policy"
+	"github.com/pinative/k8s-bot/pkg/service"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+)
+
+// A StatefulSetController is the workload controller of the statefulsets.
+type StatefulSetController struct {
+	*workloadController
+}
+
+// NewStatefulSetController manages the client and the governing services of
+// the statefulsets.
+func NewStatefulSetController(client kubernetes.Interface, informerFactory informers.SharedInformerFactory, policies *policy.Store) *StatefulSetController {
+	stsInformer := informerFactory.Apps().V1().StatefulSets()
+
+	get := func(ns, name string) (*service.Workload, metav1.Object, error) {
+		sts, err := stsInformer.Lister().StatefulSets(ns).Get(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		return service.StatefulSetWorkload(sts), sts, nil
+	}
+	reconcile := func(svc *service.Service, obj metav1.Object) error {
+		return svc.ReconcileStatefulSet(informerFactory, obj.(*appsv1.StatefulSet))
+	}
+
+	return &StatefulSetController{newWorkloadController("StatefulSet", client, informerFactory, stsInformer.Informer(), policies, get, reconcile)}
+}
@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"context"
+	"github.com/pinative/k8s-bot/pkg/policy"
+	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func newFakeStatefulSet() *v1.StatefulSet {
+	return &v1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "fake-sts-name",
+			Namespace: "fake-test",
+			Labels: map[string]string{"app": "fake-sts-name"},
+			Annotations: map[string]string{"pigo.io/part-of": testConfig.PartOf},
+		},
+		Spec: v1.StatefulSetSpec{
+			ServiceName: "fake-sts-headless",
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "main", Ports: []corev1.ContainerPort{{ContainerPort: int32(5432)}}},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestStatefulSetController_SyncStatefulSet(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fs := newFakeStatefulSet()
+	client := fake.NewSimpleClientset(fs)
+	isf := informers.NewSharedInformerFactory(client, 0)
+	sc := NewStatefulSetController(client, isf, policy.NewStore(testConfig))
+
+	_ = sc.Sync(ctx.Done())
+
+	key := fs.Namespace + "/" + fs.Name
+	if err := sc.syncWorkload(key); err != nil {
+		t.Errorf("Expected no errors occured to sync statefulset %s, but got error: %v", key, err)
+	}
+
+	// No replica is ready yet, only the governing service is created
+	svcName := testConfig.ServicePrefix + fs.Name
+	if _, err := client.CoreV1().Services(fs.Namespace).Get(context.TODO(), svcName, metav1.GetOptions{}); err == nil {
+		t.Errorf("Expected the service %s not to be created before a replica is ready", svcName)
+	}
+
+	svc, err := client.CoreV1().Services(fs.Namespace).Get(context.TODO(), fs.Spec.ServiceName, metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("Expected the governing service %s to be created, but got error: %v", fs.Spec.ServiceName, err)
+		return
+	}
+
+	if svc.Spec.ClusterIP != corev1.ClusterIPNone {
+		t.Errorf("Expected the governing service to be headless, but got cluster IP %s", svc.Spec.ClusterIP)
+	}
+
+	if ref := metav1.GetControllerOf(svc); ref == nil || ref.Kind != "StatefulSet" || ref.Name != fs.Name {
+		t.Errorf("Expected the governing service to be owned by the statefulset %s, but got %v", fs.Name, ref)
+	}
+
+	fs.Status.ReadyReplicas = 1
+	if err := isf.Apps().V1().StatefulSets().Informer().GetIndexer().Update(fs); err != nil {
+		t.Errorf("Expected no errors occured to update the statefulset %s, but got error: %v", fs.Name, err)
+	}
+	if err := sc.syncWorkload(key); err != nil {
+		t.Errorf("Expected no errors occured to sync statefulset %s, but got error: %v", key, err)
+	}
+
+	if _, err := client.CoreV1().Services(fs.Namespace).Get(context.TODO(), svcName, metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected the service %s to be created, but got error: %v", svcName, err)
+	}
+}
@@ -0,0 +1,202 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/pinative/k8s-bot/pkg/policy"
+	"github.com/pinative/k8s-bot/pkg/service"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"strings"
+)
+
+// A workloadController manages the services of the workloads of a kind, the
+// workloads are read by get and their services reconciled by reconcile.
+type workloadController struct {
+	// kind is the kind of the workloads, e.g. StatefulSet.
+	kind string
+	// name names the queue, the metrics and the logs of the controller.
+	name            string
+	client          kubernetes.Interface
+	informerFactory informers.SharedInformerFactory
+	informer        cache.SharedIndexInformer
+	queue           workqueue.RateLimitingInterface
+	recorder        record.EventRecorder
+	policies        *policy.Store
+	// get returns the workload name of the namespace ns from the lister,
+	// along with the object it was read from.
+	get func(ns, name string) (*service.Workload, metav1.Object, error)
+	// reconcile reconciles the services of the workload obj.
+	reconcile func(svc *service.Service, obj metav1.Object) error
+}
+
+func (c *workloadController) Sync(stopCh <-chan struct{}) error {
+	// Starts all the shared informers that have been created by the factory so far.
+	c.informerFactory.Start(stopCh)
+
+	// wait for the initial synchronization of the local cache.
+	if !cache.WaitForCacheSync(stopCh, c.informer.HasSynced, c.informerFactory.Core().V1().Services().Informer().HasSynced) {
+		log.Error().Msgf("failed to sync %s data", c.name)
+		return fmt.Errorf("failed to sync %s data", c.name)
+	}
+	return nil
+}
+
+// Run starts the workers reconciling the queued workloads and blocks until
+// stopCh is closed.
+func (c *workloadController) Run(workers int, stopCh <-chan struct{}) {
+	runWorkers(c.name, workers, c.queue, c.syncWorkload, stopCh)
+}
+
+// syncWorkload reconciles the services of the workload identified by key
+// with the state found in the listers.
+func (c *workloadController) syncWorkload(key string) error {
+	ns, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	w, obj, err := c.get(ns, name)
+	if k8serrors.IsNotFound(err) {
+		// The services of the workload are garbage collected along with it
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	conf := c.policies.Config(ns)
+	svc := &service.Service{
+		K8sClient: c.client,
+		Config:    conf,
+		Namespace: ns,
+		Recorder:  c.recorder,
+	}
+	if w.Annotations["pigo.io/part-of"] != conf.PartOf {
+		// The status of a workload left by the bot is stale
+		return svc.ClearStatus(w)
+	}
+
+	return c.reconcile(svc, obj)
+}
+
+// onServiceChange enqueues the workload of a bot managed service so a manual
+// change of the service is reconciled back to the desired state.
+func (c *workloadController) onServiceChange(obj interface{}) {
+	svc, ok := obj.(*v1.Service)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			return
+		}
+		if svc, ok = tombstone.Obj.(*v1.Service); !ok {
+			return
+		}
+	}
+
+	ref := metav1.GetControllerOf(svc)
+	if svc.Annotations["pigo.io/part-of"] != c.policies.Config(svc.Namespace).PartOf || ref == nil || ref.Kind != c.kind {
+		return
+	}
+	c.queue.Add(svc.Namespace + "/" + ref.Name)
+}
+
+// resync enqueues every workload so a change of the policies is applied.
+func (c *workloadController) resync(ns string) {
+	enqueueAll(c.queue, c.policies, ns, c.informer.GetStore().List())
+}
+
+func (c *workloadController) onAddFunc(obj interface{}) {
+	w, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+
+	flag := isExcludedNamespace(c.policies, w.GetNamespace())
+	if flag {
+		return
+	}
+
+	log.Printf("%s %s/%s was CREATED at %v", strings.ToUpper(c.kind), w.GetNamespace(), w.GetName(), w.GetCreationTimestamp())
+	enqueue(c.queue, obj)
+}
+
+func (c *workloadController) onUpdateFunc(old, new interface{}) {
+	countResync(c.name, old, new)
+
+	oldW, err := meta.Accessor(old)
+	if err != nil {
+		return
+	}
+	newW, err := meta.Accessor(new)
+	if err != nil {
+		return
+	}
+
+	flag := isExcludedNamespace(c.policies, oldW.GetNamespace())
+	if flag {
+		return
+	}
+
+	log.Printf("%s %s/%s was UPDATED", strings.ToUpper(c.kind), newW.GetNamespace(), newW.GetName())
+	enqueue(c.queue, new)
+}
+
+func (c *workloadController) onDeleteFunc(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	w, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+
+	flag := isExcludedNamespace(c.policies, w.GetNamespace())
+	if flag {
+		return
+	}
+
+	log.Printf("%s %s/%s was DELETED at %v", strings.ToUpper(c.kind), w.GetNamespace(), w.GetName(), w.GetDeletionTimestamp())
+	enqueue(c.queue, obj)
+}
+
+// newWorkloadController manages the services of the workloads of the kind
+// cached by informer, get and reconcile read and reconcile a workload.
+func newWorkloadController(kind string, client kubernetes.Interface, informerFactory informers.SharedInformerFactory, informer cache.SharedIndexInformer, policies *policy.Store,
+	get func(ns, name string) (*service.Workload, metav1.Object, error), reconcile func(svc *service.Service, obj metav1.Object) error) *workloadController {
+	name := strings.ToLower(kind)
+	c := &workloadController{
+		kind:            kind,
+		name:            name,
+		client:          client,
+		informerFactory: informerFactory,
+		informer:        informer,
+		queue:           newQueue(name),
+		recorder:        newRecorder(client),
+		policies:        policies,
+		get:             get,
+		reconcile:       reconcile,
+	}
+	informer.AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			AddFunc:    c.onAddFunc,
+			UpdateFunc: c.onUpdateFunc,
+			DeleteFunc: c.onDeleteFunc,
+		},
+	)
+	informerFactory.Core().V1().Services().Informer().AddEventHandler(
+		cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(old, new interface{}) { c.onServiceChange(new) },
+			DeleteFunc: c.onServiceChange,
+		},
+	)
+
+	return c
+}
@@ -1,13 +1,15 @@
 module github.com/pinative/k8s-bot
 
-go 1.14
+go 1.16
 
 require (
 	github.com/joho/godotenv v1.3.0
+	github.com/prometheus/client_golang v1.11.1
 	github.com/rs/xid v1.2.1
 	github.com/rs/zerolog v1.18.0
-	golang.org/x/sync v0.0.0-20200317015054-43a5402ce75a
-	k8s.io/api v0.17.3
-	k8s.io/apimachinery v0.17.3
-	k8s.io/client-go v0.17.3
+	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a
+	k8s.io/api v0.22.17
+	k8s.io/apimachinery v0.22.17
+	k8s.io/client-go v0.22.17
+	sigs.k8s.io/yaml v1.2.0
 )
@@ -0,0 +1,67 @@
+package observer
+
+import (
+	"context"
+	"github.com/pinative/k8s-bot/pkg/config"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"os"
+	"time"
+)
+
+// leaderElectionConfig builds the Lease based leader election configuration
+// from c, it returns nil when the leader election is not enabled.
+func leaderElectionConfig(ctx context.Context, c config.LeaderElection, client kubernetes.Interface, run func(ctx context.Context)) (*leaderelection.LeaderElectionConfig, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+
+	id := c.Identity
+	if id == "" {
+		h, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		id = h + "_" + xid.New().String()
+	}
+
+	return &leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Name:      c.LeaseName,
+				Namespace: c.Namespace,
+			},
+			Client:     client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: id},
+		},
+		LeaseDuration:   time.Duration(c.LeaseDurationInSeconds) * time.Second,
+		RenewDeadline:   time.Duration(c.RenewDeadlineInSeconds) * time.Second,
+		RetryPeriod:     time.Duration(c.RetryPeriodInSeconds) * time.Second,
+		ReleaseOnCancel: true,
+		Name:            c.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Info().Str("identity", id).Msg("started leading, starting controllers")
+				run(ctx)
+			},
+			OnStoppedLeading: func() {
+				if ctx.Err() != nil {
+					log.Info().Str("identity", id).Msg("leader lease released")
+					return
+				}
+				// The caches stay warm on standby replicas, but the workers
+				// of a former leader must never keep running.
+				log.Fatal().Str("identity", id).Msg("leader election lost")
+			},
+			OnNewLeader: func(identity string) {
+				if identity != id {
+					log.Info().Str("leader", identity).Msg("new leader elected, standing by")
+				}
+			},
+		},
+	}, nil
+}
@@ -2,100 +2,214 @@ package observer
 
 import (
 	"context"
-	"fmt"
 	botcntlr "github.com/pinative/k8s-bot/controller"
+	"github.com/pinative/k8s-bot/pkg/config"
+	"github.com/pinative/k8s-bot/pkg/gc"
+	"github.com/pinative/k8s-bot/pkg/ingress"
+	"github.com/pinative/k8s-bot/pkg/metrics"
+	"github.com/pinative/k8s-bot/pkg/policy"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
-	"k8s.io/apimachinery/pkg/util/runtime"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
-	"os"
-	"strconv"
+	"k8s.io/client-go/tools/leaderelection"
+	"net/http"
+	"strings"
 	"sync"
-	"time"
 )
 
 // A Observer observes for resources in the kubernetes cluster
 type Observer struct {
+	config   *config.Config
+	loader   *config.Loader
 	client   kubernetes.Interface
+	dynamicClient dynamic.Interface
 }
 
-// New creates a new Observer.
-func New(client kubernetes.Interface) *Observer {
+// New creates a new Observer configured by cfg, the configuration is loaded
+// again by loader when its files change unless loader is nil. The dynamic
+// client watches the exposure policies.
+func New(cfg *config.Config, loader *config.Loader, client kubernetes.Interface, dynamicClient dynamic.Interface) *Observer {
 	return &Observer{
+		config:   cfg,
+		loader:   loader,
 		client:   client,
+		dynamicClient: dynamicClient,
 	}
 }
 
 // Run runs the watcher.
 func (w *Observer) Run(ctx context.Context) error {
-	rd := os.Getenv("RESYNC_DURATION_IN_SECONDS")
-	if rd == "" {
-		rd = "0"
-	}
-	i, err := strconv.Atoi(rd)
+	iv, err := ingress.DetectAPIVersion(w.client)
 	if err != nil {
-		log.Error().Msg("Error to read the environment variable RESYNC_DURATION")
+		log.Error().Err(err).Msg("Error to discover the API version of the ingresses")
 		return err
 	}
+	log.Info().Str("version", string(iv)).Msg("ingresses are served with")
 
-	factory := informers.NewSharedInformerFactoryWithOptions(w.client, time.Duration(i) * time.Second)
-	factory.Core().V1().Services().Lister()
+	factory := informers.NewSharedInformerFactoryWithOptions(w.client, w.config.Resync(), informerOptions(w.config)...)
+	// The ingresses are cached in every namespace by their own factory, a host
+	// conflicts with the ingresses of the namespaces the bot does not manage.
+	ingressFactory := informers.NewSharedInformerFactory(w.client, w.config.Resync())
+	policies := policy.NewStore(w.config)
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		ingCntlr := botcntlr.NewIngressController(factory)
-		defer runtime.HandleCrash()
+	controllers := []botcntlr.BotController{
+		botcntlr.NewIngressController(ingressFactory, iv, policies),
+		botcntlr.NewServiceController(w.client, factory, ingressFactory, iv, policies),
+		botcntlr.NewDeploymentController(w.client, factory, policies),
+		botcntlr.NewStatefulSetController(w.client, factory, policies),
+		botcntlr.NewDaemonSetController(w.client, factory, policies),
+	}
 
-		err = ingCntlr.Sync(ctx.Done())
-		if err != nil {
-			log.Fatal().Err(err).Send()
-			runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync pod"))
-		}
+	// The metrics are served by every replica, the leader or not
+	if err := prometheus.Register(&metrics.ManagedCollector{
+		Services:  factory.Core().V1().Services().Lister(),
+		Ingresses: ingress.NewLister(ingressFactory, iv),
+		Policies:  policies,
+	}); err != nil {
+		log.Error().Err(err).Msg("failed to register the metrics of the managed objects")
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	p := &probes{}
+	if w.config.HealthProbeBindAddress == w.config.MetricsBindAddress {
+		p.register(mux)
+	} else {
+		pmux := http.NewServeMux()
+		p.register(pmux)
+		go serve(ctx, "probes", w.config.HealthProbeBindAddress, pmux)
+	}
+	go serve(ctx, "metrics", w.config.MetricsBindAddress, mux)
 
-		select {
+	// The namespaces are synced first for the namespace selector, they are
+	// cached by their own factory which is not scoped to the namespaces.
+	nc := botcntlr.NewNamespaceController(informers.NewSharedInformerFactory(w.client, w.config.Resync()), policies, controllers)
+	controllers = append([]botcntlr.BotController{nc}, controllers...)
+
+	// The policies are synced first so the other controllers start with them,
+	// the configuration is used alone when their CRDs are not installed.
+	served, err := policy.Served(w.client.Discovery())
+	if err != nil {
+		log.Error().Err(err).Msg("Error to discover the exposure policies")
+		return err
+	}
+	collector := &gc.Collector{
+		K8sClient:          w.client,
+		IngressVersion:     iv,
+		Policies:           policies,
+	}
+	if served {
+		// The policies found at start are the ones the objects are named after
+		if err := policies.Load(w.dynamicClient); err != nil {
+			log.Error().Err(err).Msg("Error to load the exposure policies")
+			return err
 		}
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		stopCh := make(chan struct{})
-		defer close(stopCh)
-		defer runtime.HandleCrash()
-
-		svcCntlr := botcntlr.NewServiceController(factory)
-		err := svcCntlr.Sync(stopCh)
-		if err != nil {
-			log.Fatal().Err(err).Send()
-			runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync service"))
+		pc := botcntlr.NewPolicyController(w.dynamicClient, w.config.Resync(), policies, controllers)
+		// The objects renamed by a policy are collected by the leader
+		pc.OnRename = func(old *config.Config) {
+			if p.leader() {
+				go migrate(ctx, old, collector)
+			}
 		}
-
-		select {
+		controllers = append([]botcntlr.BotController{pc}, controllers...)
+	} else {
+		log.Info().Msg("exposure policies are not installed, using the configuration")
+	}
+	for _, c := range controllers {
+		if err := c.Sync(ctx.Done()); err != nil {
+			return err
 		}
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		deplCntlr := botcntlr.NewDeploymentController(factory)
-		waitCh := make(chan struct{})
-		defer close(waitCh)
-		defer runtime.HandleCrash()
-
-		err = deplCntlr.Sync(waitCh)
-		if err != nil {
-			log.Fatal().Err(err).Send()
-			runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync pod"))
+	}
+	p.setSynced()
+
+	run := func(ctx context.Context) {
+		if err := botcntlr.AdoptOrphans(w.client, factory, ingressFactory, iv, policies); err != nil {
+			log.Error().Err(err).Msg("failed to adopt the orphan services and ingresses")
 		}
 
-		select {
-		case <-waitCh:
-			deplCntlr.Run(ctx.Done())
+		var wg sync.WaitGroup
+		if w.loader != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				current := w.config
+				w.loader.Watch(reloadInterval, ctx.Done(), func(cfg *config.Config) {
+					current = reload(ctx, current, cfg, policies, controllers, collector)
+				})
+			}()
 		}
-	}()
+		if w.config.GCIntervalInSeconds > 0 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				wait.Until(func() {
+					if _, err := collector.Collect(); err != nil {
+						log.Error().Err(err).Msg("failed to collect the orphan services and ingresses")
+					}
+				}, w.config.GCInterval(), ctx.Done())
+			}()
+		}
+		for _, c := range controllers {
+			wg.Add(1)
+			go func(c botcntlr.BotController) {
+				defer wg.Done()
+				c.Run(w.config.Workers, ctx.Done())
+			}(c)
+		}
+		wg.Wait()
+	}
+
+	// With leader election the informer caches above are kept warm on every
+	// replica, while only the leader runs the workers.
+	lec, err := leaderElectionConfig(ctx, w.config.LeaderElection, w.client, run)
+	if err != nil {
+		return err
+	}
+	if lec == nil {
+		p.setLeader(func() bool { return true })
+		run(ctx)
+		return nil
+	}
+
+	le, err := leaderelection.NewLeaderElector(*lec)
+	if err != nil {
+		return err
+	}
+	p.setLeader(le.IsLeader)
+	le.Run(ctx)
 
-	wg.Wait()
 	return nil
 }
+
+// informerOptions keep out of the cache the namespaces the bot never manages,
+// a single namespace without pattern is watched alone, and the excluded
+// namespaces without pattern are filtered out by the API server. The other
+// namespaces are filtered by the controllers.
+func informerOptions(cfg *config.Config) []informers.SharedInformerOption {
+	if len(cfg.Namespaces) == 1 && !isPattern(cfg.Namespaces[0]) {
+		return []informers.SharedInformerOption{informers.WithNamespace(cfg.Namespaces[0])}
+	}
+
+	var selectors []fields.Selector
+	for _, ns := range cfg.ExcludeNamespaces {
+		if !isPattern(ns) {
+			selectors = append(selectors, fields.OneTermNotEqualSelector("metadata.namespace", ns))
+		}
+	}
+	if len(selectors) == 0 {
+		return nil
+	}
+	selector := fields.AndSelectors(selectors...).String()
+
+	return []informers.SharedInformerOption{informers.WithTweakListOptions(func(o *metav1.ListOptions) {
+		o.FieldSelector = selector
+	})}
+}
+
+func isPattern(ns string) bool {
+	return strings.ContainsAny(ns, `*?[\`)
+}
@@ -0,0 +1,84 @@
+package observer
+
+import (
+	"context"
+	botcntlr "github.com/pinative/k8s-bot/controller"
+	"github.com/pinative/k8s-bot/pkg/config"
+	"github.com/pinative/k8s-bot/pkg/gc"
+	"github.com/pinative/k8s-bot/pkg/policy"
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"strings"
+	"time"
+)
+
+const (
+	// reloadInterval is the interval the configuration files are polled at.
+	reloadInterval = 10 * time.Second
+	// migrateInterval is the interval the objects named after a previous
+	// configuration are collected at.
+	migrateInterval = 5 * time.Second
+)
+
+// reload applies cfg, the configuration loaded again, in place of current
+// and resyncs the controllers. It returns the configuration applied.
+//
+// A configuration which renames every managed object is refused unless it
+// allows it, the objects named after current are then collected once the
+// controllers have created their counterparts.
+func reload(ctx context.Context, current, cfg *config.Config, policies *policy.Store, controllers []botcntlr.BotController, collector *gc.Collector) *config.Config {
+	old, conf := policies.Config(""), policies.ConfigWithBase(cfg, "")
+	if conf.Renames(old) && !cfg.AllowRename {
+		log.Error().
+			Str("partOf", conf.PartOf).
+			Str("servicePrefix", conf.ServicePrefix).
+			Str("ingressPrefix", conf.IngressPrefix).
+			Msg("the configuration renames every managed object, set allowRename to apply it, keeping the current one")
+		return current
+	}
+	if err := policies.SetBase(cfg); err != nil {
+		log.Error().Err(err).Msg("invalid configuration, keeping the current one")
+		return current
+	}
+
+	prev := current.Values()
+	for i, v := range cfg.Values() {
+		if v.Value != prev[i].Value {
+			log.Info().Str("value", v.Value).Str("previous", prev[i].Value).Msg(v.Flag)
+		}
+	}
+	if cfg.Workers != current.Workers || cfg.ResyncDurationInSeconds != current.ResyncDurationInSeconds ||
+		cfg.GCIntervalInSeconds != current.GCIntervalInSeconds || cfg.LeaderElection != current.LeaderElection ||
+		cfg.MetricsBindAddress != current.MetricsBindAddress || cfg.HealthProbeBindAddress != current.HealthProbeBindAddress {
+		log.Warn().Msg("the workers, the resync duration, the gc interval, the leader election and the addresses of the metrics and the probes are applied once the bot restarts")
+	}
+	if strings.Join(cfg.Namespaces, ",") != strings.Join(current.Namespaces, ",") ||
+		strings.Join(cfg.ExcludeNamespaces, ",") != strings.Join(current.ExcludeNamespaces, ",") {
+		log.Warn().Msg("the namespaces kept out of the cache of the informers are updated once the bot restarts")
+	}
+	log.Info().Msg("configuration reloaded, resyncing the controllers")
+	botcntlr.Resync(controllers, "")
+
+	if conf.Renames(old) {
+		go migrate(ctx, old, collector)
+	}
+
+	return cfg
+}
+
+// migrate collects the objects named after the configuration old until none
+// is left waiting for its counterpart, or until ctx is done.
+func migrate(ctx context.Context, old *config.Config, collector *gc.Collector) {
+	_ = wait.PollImmediateUntil(migrateInterval, func() (bool, error) {
+		_, pending, err := collector.CollectRenamed(old)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to collect the renamed services and ingresses")
+			return false, nil
+		}
+		if pending > 0 {
+			log.Info().Int("pending", pending).Msg("waiting for the renamed services and ingresses to be created")
+		}
+
+		return pending == 0, nil
+	}, ctx.Done())
+}
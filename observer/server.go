@@ -0,0 +1,98 @@
+package observer
+
+import (
+	"context"
+	"fmt"
+	botcntlr "github.com/pinative/k8s-bot/controller"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// shutdownTimeout is the time the requests in progress are given to complete
+// once the bot stops.
+const shutdownTimeout = 5 * time.Second
+
+// serve serves handler on addr until ctx is done, nothing is served when addr
+// is empty or 0.
+func serve(ctx context.Context, name, addr string, handler http.Handler) {
+	if addr == "" || addr == "0" {
+		return
+	}
+
+	srv := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = srv.Shutdown(sctx)
+	}()
+
+	log.Info().Str("address", addr).Msgf("serving the %s", name)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Error().Err(err).Str("address", addr).Msgf("failed to serve the %s", name)
+	}
+}
+
+// stallTimeout is the time a worker reconciles the same key for before the
+// bot is deemed deadlocked.
+const stallTimeout = 5 * time.Minute
+
+// probes serve the /healthz and /readyz endpoints of the bot.
+type probes struct {
+	mu     sync.RWMutex
+	synced bool
+	// isLeader reports the leader status, it is nil until the leader election
+	// has started.
+	isLeader func() bool
+}
+
+// register adds the handlers of the probes to mux.
+func (p *probes) register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", p.healthz)
+	mux.HandleFunc("/readyz", p.readyz)
+}
+
+// setSynced marks the caches of the informers synced.
+func (p *probes) setSynced() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.synced = true
+}
+
+// setLeader sets the function reporting the leader status.
+func (p *probes) setLeader(isLeader func() bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.isLeader = isLeader
+}
+
+// leader returns true if the bot is the leader.
+func (p *probes) leader() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.isLeader != nil && p.isLeader()
+}
+
+// healthz fails when a worker is deadlocked.
+func (p *probes) healthz(w http.ResponseWriter, _ *http.Request) {
+	if err := botcntlr.CheckWorkers(stallTimeout); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz fails until the caches of the informers are synced, it reports the
+// leader status without depending on it so the standby replicas are ready.
+func (p *probes) readyz(w http.ResponseWriter, _ *http.Request) {
+	p.mu.RLock()
+	synced, leader := p.synced, p.isLeader != nil && p.isLeader()
+	p.mu.RUnlock()
+
+	if !synced {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintf(w, "synced: %t\nleader: %t\n", synced, leader)
+}
@@ -0,0 +1,531 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"github.com/joho/godotenv"
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"os"
+	"path"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Config is the configuration of the bot, it is loaded once at startup and
+// injected into the controllers.
+type Config struct {
+	// PartOf is the value of the pigo.io/part-of annotation of the managed objects.
+	PartOf string `json:"partOf,omitempty"`
+	// ServicePrefix is prepended to the name of the workload of a service.
+	ServicePrefix string `json:"servicePrefix,omitempty"`
+	// IngressPrefix is prepended to the name of the workload of an ingress.
+	IngressPrefix string `json:"ingressPrefix,omitempty"`
+	// Domain is the public DNS domain of the hostnames.
+	Domain string `json:"domain,omitempty"`
+	// HostnameStrategy is template or random.
+	HostnameStrategy string `json:"hostnameStrategy,omitempty"`
+	// HostnameTemplate renders the hostnames of the template strategy.
+	HostnameTemplate string `json:"hostnameTemplate,omitempty"`
+	// IngressClass is the class of the ingresses, empty for the default class.
+	IngressClass string `json:"ingressClass,omitempty"`
+	// TLSSecret is the secret terminating the TLS of every ingress.
+	TLSSecret string `json:"tlsSecret,omitempty"`
+	// TLSClusterIssuer is the cert-manager ClusterIssuer of the certificates
+	// of the ingresses, it takes precedence over TLSSecret.
+	TLSClusterIssuer string `json:"tlsClusterIssuer,omitempty"`
+	// TLSForceSSLRedirect redirects HTTP to HTTPS.
+	TLSForceSSLRedirect bool `json:"tlsForceSSLRedirect,omitempty"`
+	// ServiceType is the default of the pigo.network/service-type annotation.
+	ServiceType string `json:"serviceType,omitempty"`
+	// DefaultExpose is the default of the pigo.network/allow-internet-access
+	// annotation.
+	DefaultExpose bool `json:"defaultExpose,omitempty"`
+	// Namespaces are the glob patterns of the namespaces managed by the bot,
+	// every namespace when empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// ExcludeNamespaces are the glob patterns of the namespaces the bot
+	// never manages.
+	ExcludeNamespaces []string `json:"excludeNamespaces,omitempty"`
+	// NamespaceSelector selects the namespaces managed by the bot by their
+	// labels.
+	NamespaceSelector string `json:"namespaceSelector,omitempty"`
+	// Workers is the number of workers of each controller.
+	Workers int `json:"workers,omitempty"`
+	// ResyncDurationInSeconds is the resync period of the informers, 0
+	// disables it.
+	ResyncDurationInSeconds int `json:"resyncDurationInSeconds,omitempty"`
+	// GCIntervalInSeconds is the interval of the garbage collection, 0
+	// disables it.
+	GCIntervalInSeconds int            `json:"gcIntervalInSeconds,omitempty"`
+	LeaderElection      LeaderElection `json:"leaderElection,omitempty"`
+	// AllowRename lets a reload change the prefixes or the part-of value,
+	// which renames or releases every managed object.
+	AllowRename bool `json:"allowRename,omitempty"`
+	// MetricsBindAddress is the address the metrics are served on, 0
+	// disables them.
+	MetricsBindAddress string `json:"metricsBindAddress,omitempty"`
+	// HealthProbeBindAddress is the address the /healthz and /readyz probes
+	// are served on, 0 disables them.
+	HealthProbeBindAddress string `json:"healthProbeBindAddress,omitempty"`
+
+	// File is the path of the configuration file, empty when there is none.
+	File string `json:"-"`
+	// sources are the sources of the settings keyed by flag, the settings
+	// left out are defaults.
+	sources map[string]Source
+}
+
+// A Source is where the value of a setting came from.
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnvFile Source = "env file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+// A Value is the effective value of a setting.
+type Value struct {
+	Flag   string
+	Env    string
+	Value  string
+	Source Source
+}
+
+// LeaderElection configures the Lease based leader election.
+type LeaderElection struct {
+	Enabled   bool   `json:"enabled,omitempty"`
+	LeaseName string `json:"leaseName,omitempty"`
+	// Namespace of the Lease, it defaults to the namespace of the pod.
+	Namespace string `json:"namespace,omitempty"`
+	// Identity of the replica, it defaults to the hostname.
+	Identity               string `json:"identity,omitempty"`
+	LeaseDurationInSeconds int    `json:"leaseDurationInSeconds,omitempty"`
+	RenewDeadlineInSeconds int    `json:"renewDeadlineInSeconds,omitempty"`
+	RetryPeriodInSeconds   int    `json:"retryPeriodInSeconds,omitempty"`
+}
+
+// A setting is a field of the configuration read from a flag and an
+// environment variable.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	// field returns the *string, *int, *bool or *[]string of the setting in
+	// c.
+	field func(c *Config) interface{}
+}
+
+var settings = []setting{
+	{"part-of", "ANNOT_PIGO_IO_PARTOF", "value of the pigo.io/part-of annotation of the managed objects", func(c *Config) interface{} { return &c.PartOf }},
+	{"service-prefix", "BOT_SERVICE_PREFIX", "prefix of the names of the services", func(c *Config) interface{} { return &c.ServicePrefix }},
+	{"ingress-prefix", "BOT_INGRESS_PREFIX", "prefix of the names of the ingresses", func(c *Config) interface{} { return &c.IngressPrefix }},
+	{"domain", "PUBLIC_DNS_DOMAIN", "public DNS domain of the hostnames", func(c *Config) interface{} { return &c.Domain }},
+	{"hostname-strategy", "BOT_HOSTNAME_STRATEGY", "hostname strategy, template or random", func(c *Config) interface{} { return &c.HostnameStrategy }},
+	{"hostname-template", "BOT_HOSTNAME_TEMPLATE", "template of the hostnames", func(c *Config) interface{} { return &c.HostnameTemplate }},
+	{"ingress-class", "BOT_INGRESS_CLASS", "class of the ingresses", func(c *Config) interface{} { return &c.IngressClass }},
+	{"tls-secret", "BOT_TLS_SECRET", "secret terminating the TLS of the ingresses", func(c *Config) interface{} { return &c.TLSSecret }},
+	{"tls-cluster-issuer", "BOT_TLS_CLUSTER_ISSUER", "cert-manager ClusterIssuer of the certificates of the ingresses", func(c *Config) interface{} { return &c.TLSClusterIssuer }},
+	{"tls-force-ssl-redirect", "BOT_TLS_FORCE_SSL_REDIRECT", "redirect HTTP to HTTPS", func(c *Config) interface{} { return &c.TLSForceSSLRedirect }},
+	{"service-type", "BOT_SERVICE_TYPE", "default type of the services", func(c *Config) interface{} { return &c.ServiceType }},
+	{"default-expose", "BOT_DEFAULT_EXPOSE", "expose the workloads to the internet unless annotated otherwise", func(c *Config) interface{} { return &c.DefaultExpose }},
+	{"namespaces", "BOT_NAMESPACES", "comma separated glob patterns of the managed namespaces", func(c *Config) interface{} { return &c.Namespaces }},
+	{"exclude-namespaces", "BOT_EXCLUDE_NAMESPACES", "comma separated glob patterns of the namespaces never managed", func(c *Config) interface{} { return &c.ExcludeNamespaces }},
+	{"namespace-selector", "BOT_NAMESPACE_SELECTOR", "label selector of the managed namespaces", func(c *Config) interface{} { return &c.NamespaceSelector }},
+	{"workers", "BOT_WORKERS", "number of workers of each controller", func(c *Config) interface{} { return &c.Workers }},
+	{"resync", "RESYNC_DURATION_IN_SECONDS", "resync period of the informers in seconds", func(c *Config) interface{} { return &c.ResyncDurationInSeconds }},
+	{"gc-interval", "GC_INTERVAL_IN_SECONDS", "interval of the garbage collection in seconds", func(c *Config) interface{} { return &c.GCIntervalInSeconds }},
+	{"allow-rename", "BOT_ALLOW_RENAME", "allow a reload to change the prefixes or the part-of value", func(c *Config) interface{} { return &c.AllowRename }},
+	{"metrics-bind-address", "BOT_METRICS_BIND_ADDRESS", "address the /metrics endpoint listens on, 0 disables it", func(c *Config) interface{} { return &c.MetricsBindAddress }},
+	{"health-probe-bind-address", "BOT_HEALTH_PROBE_BIND_ADDRESS", "address the /healthz and /readyz probes listen on, 0 disables them", func(c *Config) interface{} { return &c.HealthProbeBindAddress }},
+	{"leader-elect", "LEADER_ELECT", "enable the leader election", func(c *Config) interface{} { return &c.LeaderElection.Enabled }},
+	{"leader-election-lease-name", "LEADER_ELECTION_LEASE_NAME", "name of the Lease", func(c *Config) interface{} { return &c.LeaderElection.LeaseName }},
+	{"leader-election-namespace", "LEADER_ELECTION_NAMESPACE", "namespace of the Lease", func(c *Config) interface{} { return &c.LeaderElection.Namespace }},
+	{"leader-election-identity", "POD_NAME", "identity of the replica", func(c *Config) interface{} { return &c.LeaderElection.Identity }},
+	{"leader-election-lease-duration", "LEADER_ELECTION_LEASE_DURATION_IN_SECONDS", "duration standby replicas wait before taking over in seconds", func(c *Config) interface{} { return &c.LeaderElection.LeaseDurationInSeconds }},
+	{"leader-election-renew-deadline", "LEADER_ELECTION_RENEW_DEADLINE_IN_SECONDS", "duration the leader retries to renew the Lease in seconds", func(c *Config) interface{} { return &c.LeaderElection.RenewDeadlineInSeconds }},
+	{"leader-election-retry-period", "LEADER_ELECTION_RETRY_PERIOD_IN_SECONDS", "interval between two attempts in seconds", func(c *Config) interface{} { return &c.LeaderElection.RetryPeriodInSeconds }},
+}
+
+// Default returns the configuration used for the settings left unset.
+func Default() *Config {
+	return &Config{
+		PartOf:                 "k8s.bot",
+		HostnameStrategy:       "template",
+		ExcludeNamespaces:      []string{"kube-system", "ingress-nginx", "kube-public", "monitor"},
+		Workers:                2,
+		GCIntervalInSeconds:    3600,
+		MetricsBindAddress:     ":8080",
+		HealthProbeBindAddress: ":8081",
+		LeaderElection: LeaderElection{
+			LeaseName:              "k8s-bot",
+			LeaseDurationInSeconds: 15,
+			RenewDeadlineInSeconds: 10,
+			RetryPeriodInSeconds:   2,
+		},
+	}
+}
+
+// A Loader loads the configuration from the defaults, the YAML file named by
+// --config or BOT_CONFIG_FILE, the .env file, the environment variables and
+// the flags, in that order of precedence from the lowest.
+type Loader struct {
+	fs   *flag.FlagSet
+	file *string
+	// contents are the contents of the files read by the last Load, empty
+	// for the missing ones.
+	contents map[string]string
+}
+
+// NewLoader adds the flags of the settings to fs and parses args with it.
+func NewLoader(fs *flag.FlagSet, args []string) (*Loader, error) {
+	l := &Loader{fs: fs}
+	l.file = fs.String("config", "", "path of the YAML configuration file (BOT_CONFIG_FILE)")
+	for _, s := range settings {
+		_, isBool := s.field(&Config{}).(*bool)
+		fs.Var(&flagValue{isBool: isBool}, s.flag, s.usage+" ("+s.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Load parses args with fs and returns the configuration, the flags of the
+// settings are added to fs.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	l, err := NewLoader(fs, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.Load()
+}
+
+// Load reads the files again and returns the configuration.
+func (l *Loader) Load() (*Config, error) {
+	l.contents = map[string]string{}
+
+	// The .env file is read from the directory BOT_ENV_FILE_PATH, it is
+	// optional unless the directory is set.
+	envFile := os.Getenv("BOT_ENV_FILE_PATH")
+	if envFile != "" && !strings.HasSuffix(envFile, "/") {
+		envFile = envFile + "/"
+	}
+	envFile += ".env"
+	dotenv := map[string]string{}
+	l.contents[envFile] = ""
+	if data, err := os.ReadFile(envFile); err == nil {
+		l.contents[envFile] = string(data)
+		if dotenv, err = godotenv.Unmarshal(string(data)); err != nil {
+			return nil, fmt.Errorf("error to read the .env file %s: %v", envFile, err)
+		}
+	} else if !os.IsNotExist(err) || os.Getenv("BOT_ENV_FILE_PATH") != "" {
+		return nil, fmt.Errorf("error to read the .env file %s: %v", envFile, err)
+	}
+	getenv := func(key string) (string, Source) {
+		if v := os.Getenv(key); v != "" {
+			return v, SourceEnv
+		}
+		return dotenv[key], SourceEnvFile
+	}
+
+	c := Default()
+	c.sources = map[string]Source{}
+	c.File = *l.file
+	if c.File == "" {
+		c.File, _ = getenv("BOT_CONFIG_FILE")
+	}
+	if c.File != "" {
+		l.contents[c.File] = ""
+		data, err := os.ReadFile(c.File)
+		if err != nil {
+			return nil, err
+		}
+		l.contents[c.File] = string(data)
+		before := c.Values()
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return nil, fmt.Errorf("error to read the configuration file %s: %v", c.File, err)
+		}
+		for i, v := range c.Values() {
+			if v.Value != before[i].Value {
+				c.sources[v.Flag] = SourceFile
+			}
+		}
+	}
+	for _, s := range settings {
+		if v, src := getenv(s.env); v != "" {
+			if err := set(s.field(c), v); err != nil {
+				return nil, fmt.Errorf("error to read the environment variable %s: %v", s.env, err)
+			}
+			c.sources[s.flag] = src
+		}
+	}
+	var err error
+	l.fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				if err = set(s.field(c), f.Value.String()); err != nil {
+					err = fmt.Errorf("error to read the flag --%s: %v", s.flag, err)
+				}
+				c.sources[s.flag] = SourceFlag
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if c.LeaderElection.Namespace == "" {
+		var src Source
+		if c.LeaderElection.Namespace, src = getenv("POD_NAMESPACE"); c.LeaderElection.Namespace != "" {
+			c.sources["leader-election-namespace"] = src
+		}
+	}
+	if c.LeaderElection.Namespace == "" {
+		c.LeaderElection.Namespace = "kube-system"
+	}
+
+	return c, c.Validate()
+}
+
+// Changed returns true if the files read by the last Load have changed since.
+func (l *Loader) Changed() bool {
+	for f, data := range l.contents {
+		// A missing file reads as an empty one.
+		b, _ := os.ReadFile(f)
+		if string(b) != data {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Watch calls fn with the configuration loaded again every time the files
+// change, it polls them every interval until stopCh is closed. The files
+// mounted from a ConfigMap are replaced as a whole by the kubelet, polling
+// them keeps up with it. An invalid configuration is logged and skipped.
+func (l *Loader) Watch(interval time.Duration, stopCh <-chan struct{}, fn func(c *Config)) {
+	wait.Until(func() {
+		if !l.Changed() {
+			return
+		}
+		c, err := l.Load()
+		if err != nil {
+			log.Error().Err(err).Msg("invalid configuration, keeping the current one")
+			return
+		}
+		fn(c)
+	}, interval, stopCh)
+}
+
+var prefixRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*)?$`)
+
+// Validate returns the errors of the configuration.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.PartOf == "" {
+		errs = append(errs, fmt.Errorf("the part-of annotation value should not be empty"))
+	}
+	for n, p := range map[string]string{"service prefix": c.ServicePrefix, "ingress prefix": c.IngressPrefix} {
+		if p != "" && (!prefixRegexp.MatchString(p) || len(p) > validation.DNS1123LabelMaxLength) {
+			errs = append(errs, fmt.Errorf("the %s %q should be the start of a DNS-1123 label", n, p))
+		}
+	}
+	if d := strings.TrimPrefix(c.Domain, "."); d != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(d) {
+			errs = append(errs, fmt.Errorf("the domain %q is not a valid DNS suffix: %s", c.Domain, msg))
+		}
+	}
+	if c.HostnameStrategy != "template" && c.HostnameStrategy != "random" {
+		errs = append(errs, fmt.Errorf("unknown hostname strategy %q", c.HostnameStrategy))
+	}
+	if _, err := template.New("hostname").Parse(c.HostnameTemplate); err != nil {
+		errs = append(errs, fmt.Errorf("invalid hostname template: %v", err))
+	} else if c.TLSSecret != "" && c.TLSClusterIssuer == "" && c.HostnameStrategy == "template" && !singleLabelTemplate(c.HostnameTemplate) {
+		log.Warn().Msgf("the hostname template %q renders more than one label under the domain, the hosts are not covered by the wildcard certificate of the TLS secret %s", c.HostnameTemplate, c.TLSSecret)
+	}
+	switch c.ServiceType {
+	case "", "ClusterIP", "NodePort", "LoadBalancer", "Headless":
+	default:
+		errs = append(errs, fmt.Errorf("unknown service type %q", c.ServiceType))
+	}
+	for _, p := range append(c.Namespaces, c.ExcludeNamespaces...) {
+		if _, err := path.Match(p, ""); err != nil {
+			errs = append(errs, fmt.Errorf("invalid namespace pattern %q: %v", p, err))
+		}
+	}
+	if _, err := labels.Parse(c.NamespaceSelector); err != nil {
+		errs = append(errs, fmt.Errorf("invalid namespace selector: %v", err))
+	}
+	if c.Workers < 1 {
+		errs = append(errs, fmt.Errorf("the number of workers should be at least 1"))
+	}
+	if c.ResyncDurationInSeconds < 0 || c.GCIntervalInSeconds < 0 {
+		errs = append(errs, fmt.Errorf("the resync duration and the gc interval should not be negative"))
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// IsExcludedNamespace returns true if the namespace ns is out of Namespaces
+// or matches ExcludeNamespaces, the NamespaceSelector is left to the caller.
+func (c *Config) IsExcludedNamespace(ns string) bool {
+	return MatchNamespace(c.ExcludeNamespaces, ns) || (len(c.Namespaces) > 0 && !MatchNamespace(c.Namespaces, ns))
+}
+
+// Selector returns the NamespaceSelector, it selects every namespace when
+// the selector is empty or invalid.
+func (c *Config) Selector() labels.Selector {
+	sel, err := labels.Parse(c.NamespaceSelector)
+	if err != nil {
+		return labels.Everything()
+	}
+
+	return sel
+}
+
+// MatchNamespace returns true if the namespace ns matches one of the glob
+// patterns.
+func MatchNamespace(patterns []string, ns string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, ns); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Values returns the effective value of every setting and its source, in the
+// order of the flags.
+func (c *Config) Values() []Value {
+	values := make([]Value, 0, len(settings))
+	for _, s := range settings {
+		src, ok := c.sources[s.flag]
+		if !ok {
+			src = SourceDefault
+		}
+		values = append(values, Value{Flag: s.flag, Env: s.env, Value: get(s.field(c)), Source: src})
+	}
+
+	return values
+}
+
+// Renames returns true if the objects managed under the configuration old
+// are named or annotated differently under c.
+func (c *Config) Renames(old *Config) bool {
+	return c.PartOf != old.PartOf || c.ServicePrefix != old.ServicePrefix || c.IngressPrefix != old.IngressPrefix
+}
+
+// ServiceName returns the name of the service of the workload name.
+func (c *Config) ServiceName(name string) string {
+	return c.ServicePrefix + name
+}
+
+// WorkloadName returns the name of the workload of the service sn.
+func (c *Config) WorkloadName(sn string) string {
+	return strings.TrimPrefix(sn, c.ServicePrefix)
+}
+
+// IngressName returns the name of the ingress of the service sn.
+func (c *Config) IngressName(sn string) string {
+	return c.IngressPrefix + c.WorkloadName(sn)
+}
+
+// Resync returns the resync period of the informers.
+func (c *Config) Resync() time.Duration {
+	return time.Duration(c.ResyncDurationInSeconds) * time.Second
+}
+
+// GCInterval returns the interval of the garbage collection.
+func (c *Config) GCInterval() time.Duration {
+	return time.Duration(c.GCIntervalInSeconds) * time.Second
+}
+
+func set(field interface{}, v string) (err error) {
+	switch f := field.(type) {
+	case *string:
+		*f = v
+	case *int:
+		*f, err = strconv.Atoi(v)
+	case *bool:
+		*f, err = strconv.ParseBool(v)
+	case *[]string:
+		*f = nil
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				*f = append(*f, s)
+			}
+		}
+	}
+
+	return
+}
+
+func get(field interface{}) string {
+	switch f := field.(type) {
+	case *string:
+		return *f
+	case *int:
+		return strconv.Itoa(*f)
+	case *bool:
+		return strconv.FormatBool(*f)
+	case *[]string:
+		return strings.Join(*f, ",")
+	}
+
+	return ""
+}
+
+// flagValue keeps the raw value of a flag, it is set into the configuration
+// once the file and the environment have been read.
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (f *flagValue) String() string {
+	return f.value
+}
+
+func (f *flagValue) Set(v string) error {
+	f.value = v
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// singleLabelTemplate returns true if the hostname template tmpl renders a
+// single label under the domain, as a wildcard certificate of the domain
+// requires. The empty template stands for the default one, which renders the
+// name and the namespace.
+func singleLabelTemplate(tmpl string) bool {
+	if tmpl == "" {
+		return false
+	}
+	t, err := template.New("hostname").Parse(tmpl)
+	if err != nil {
+		return false
+	}
+	var b strings.Builder
+	if err = t.Execute(&b, struct{ Name, Namespace, Domain string }{"name", "namespace", "domain"}); err != nil {
+		return false
+	}
+	h := strings.Trim(b.String(), ".")
+
+	return strings.HasSuffix(h, ".domain") && !strings.Contains(strings.TrimSuffix(h, ".domain"), ".")
+}
@@ -0,0 +1,185 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	data := []byte("servicePrefix: file-\ningressPrefix: file-\nworkers: 4\nleaderElection:\n  enabled: true\n")
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BOT_CONFIG_FILE", p)
+	t.Setenv("BOT_SERVICE_PREFIX", "env-")
+	t.Setenv("BOT_INGRESS_PREFIX", "env-")
+
+	c, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"--ingress-prefix", "flag-"})
+	if err != nil {
+		t.Errorf("Expected no errors occured to load the configuration, but got error: %v", err)
+		return
+	}
+
+	if c.Workers != 4 || !c.LeaderElection.Enabled {
+		t.Errorf("Expected the settings of the file, but got %+v", c)
+	}
+	if c.ServicePrefix != "env-" {
+		t.Errorf("Expected the environment to override the file env-, but got %s", c.ServicePrefix)
+	}
+	if c.IngressPrefix != "flag-" {
+		t.Errorf("Expected the flag to override the environment flag-, but got %s", c.IngressPrefix)
+	}
+	if c.PartOf != "k8s.bot" || c.LeaderElection.LeaseName != "k8s-bot" {
+		t.Errorf("Expected the defaults of the settings left unset, but got %+v", c)
+	}
+}
+
+func TestConfig_Values(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(p, []byte("workers: 4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BOT_SERVICE_PREFIX", "env-")
+
+	c, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"--config", p, "--domain", ".apps.example.com"})
+	if err != nil {
+		t.Errorf("Expected no errors occured to load the configuration, but got error: %v", err)
+		return
+	}
+	if c.File != p {
+		t.Errorf("Expected the configuration file %s, but got %s", p, c.File)
+	}
+
+	expected := map[string]Value{
+		"workers":        {Flag: "workers", Env: "BOT_WORKERS", Value: "4", Source: SourceFile},
+		"service-prefix": {Flag: "service-prefix", Env: "BOT_SERVICE_PREFIX", Value: "env-", Source: SourceEnv},
+		"domain":         {Flag: "domain", Env: "PUBLIC_DNS_DOMAIN", Value: ".apps.example.com", Source: SourceFlag},
+		"part-of":        {Flag: "part-of", Env: "ANNOT_PIGO_IO_PARTOF", Value: "k8s.bot", Source: SourceDefault},
+	}
+	for _, v := range c.Values() {
+		if e, ok := expected[v.Flag]; ok && v != e {
+			t.Errorf("Expected the value %+v, but got %+v", e, v)
+		}
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name  string
+		apply func(c *Config)
+		valid bool
+	}{
+		{"default", func(c *Config) {}, true},
+		{"domain", func(c *Config) { c.Domain = ".apps.example.com" }, true},
+		{"invalid domain", func(c *Config) { c.Domain = ".apps_example.com" }, false},
+		{"invalid service prefix", func(c *Config) { c.ServicePrefix = "Svc_" }, false},
+		{"invalid ingress prefix", func(c *Config) { c.IngressPrefix = "-ing" }, false},
+		{"invalid hostname strategy", func(c *Config) { c.HostnameStrategy = "fixed" }, false},
+		{"invalid service type", func(c *Config) { c.ServiceType = "ExternalName" }, false},
+		{"no workers", func(c *Config) { c.Workers = 0 }, false},
+		{"invalid namespace pattern", func(c *Config) { c.Namespaces = []string{"team-["} }, false},
+		{"invalid namespace selector", func(c *Config) { c.NamespaceSelector = "k8s-bot.pigo.io/enabled in true" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			tt.apply(c)
+			if err := c.Validate(); (err == nil) != tt.valid {
+				t.Errorf("Expected the configuration to be valid %v, but got error: %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestSingleLabelTemplate(t *testing.T) {
+	for tmpl, single := range map[string]bool{
+		"":                                     false,
+		"{{.Name}}.{{.Namespace}}.{{.Domain}}": false,
+		"{{.Name}}-{{.Namespace}}.{{.Domain}}": true,
+		"{{.Name}}.{{.Domain}}":                true,
+		"{{.Name}}.apps.{{.Domain}}":           false,
+		"{{.Name}}.example.com":                false,
+	} {
+		if singleLabelTemplate(tmpl) != single {
+			t.Errorf("Expected the template %q to render a single label %v, but got %v", tmpl, single, !single)
+		}
+	}
+}
+
+func TestLoader_Changed(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("BOT_ENV_FILE_PATH", dir)
+	if err := os.WriteFile(filepath.Join(dir, ".env"), []byte("BOT_SERVICE_PREFIX=svc-\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := NewLoader(flag.NewFlagSet("test", flag.ContinueOnError), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := l.Load()
+	if err != nil {
+		t.Errorf("Expected no errors occured to load the configuration, but got error: %v", err)
+		return
+	}
+	if c.ServicePrefix != "svc-" || c.Values()[1].Source != SourceEnvFile {
+		t.Errorf("Expected the service prefix svc- of the .env file, but got %+v", c.Values()[1])
+	}
+	if l.Changed() {
+		t.Errorf("Expected the files not to be changed")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, ".env"), []byte("BOT_SERVICE_PREFIX=bot-\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !l.Changed() {
+		t.Errorf("Expected the change of the .env file to be detected")
+	}
+	if c, _ = l.Load(); c.ServicePrefix != "bot-" {
+		t.Errorf("Expected the service prefix bot- loaded again, but got %s", c.ServicePrefix)
+	}
+	if l.Changed() {
+		t.Errorf("Expected the files not to be changed once loaded again")
+	}
+}
+
+func TestConfig_Renames(t *testing.T) {
+	c := Default()
+	c.ServicePrefix = "svc-"
+	if c.Renames(c) {
+		t.Errorf("Expected the same configuration not to rename the objects")
+	}
+
+	n := *c
+	n.Domain = ".apps.example.com"
+	if n.Renames(c) {
+		t.Errorf("Expected a new domain not to rename the objects")
+	}
+	n.ServicePrefix = "bot-"
+	if !n.Renames(c) {
+		t.Errorf("Expected a new service prefix to rename the objects")
+	}
+}
+
+func TestConfig_IsExcludedNamespace(t *testing.T) {
+	c := Default()
+	if err := set(&c.Namespaces, "team-*, apps"); err != nil {
+		t.Fatal(err)
+	}
+	c.ExcludeNamespaces = append(c.ExcludeNamespaces, "team-sandbox-*")
+
+	for ns, excluded := range map[string]bool{
+		"team-a":           false,
+		"apps":             false,
+		"team-sandbox-foo": true,
+		"kube-system":      true,
+		"default":          true,
+	} {
+		if c.IsExcludedNamespace(ns) != excluded {
+			t.Errorf("Expected the namespace %s to be excluded %v, but got %v", ns, excluded, !excluded)
+		}
+	}
+}
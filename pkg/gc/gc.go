@@ -0,0 +1,244 @@
+package gc
+
+import (
+	"context"
+	"github.com/pinative/k8s-bot/pkg/config"
+	"github.com/pinative/k8s-bot/pkg/ingress"
+	"github.com/pinative/k8s-bot/pkg/policy"
+	"github.com/rs/zerolog/log"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+)
+
+// A Collector deletes the bot managed services and ingresses whose source
+// deployment, statefulset, daemonset or service no longer exists.
+type Collector struct {
+	K8sClient kubernetes.Interface
+	// Policies give the configuration of the bot, and exclude namespaces.
+	Policies *policy.Store
+	// DryRun only reports the objects which would be deleted.
+	DryRun bool
+	// IngressVersion is the API version the ingresses are served with.
+	IngressVersion ingress.APIVersion
+}
+
+// An Orphan is a bot managed object without its source object.
+type Orphan struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+// Collect deletes the orphan services and ingresses, and returns them. The
+// objects are matched with the configuration of their namespace.
+func (c *Collector) Collect() (orphans []Orphan, err error) {
+	deploys, err := c.K8sClient.AppsV1().Deployments(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	workloads := map[string]bool{}
+	for _, d := range deploys.Items {
+		workloads["Deployment/"+d.Namespace+"/"+d.Name] = true
+	}
+	sts, err := c.K8sClient.AppsV1().StatefulSets(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sts.Items {
+		workloads["StatefulSet/"+s.Namespace+"/"+s.Name] = true
+	}
+	dss, err := c.K8sClient.AppsV1().DaemonSets(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, ds := range dss.Items {
+		workloads["DaemonSet/"+ds.Namespace+"/"+ds.Name] = true
+	}
+
+	svcs, err := c.K8sClient.CoreV1().Services(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	services := map[string]bool{}
+	for _, svc := range svcs.Items {
+		conf := c.Policies.Config(svc.Namespace)
+		if c.isExcluded(svc.Namespace) || svc.Annotations["pigo.io/part-of"] != conf.PartOf || !strings.HasPrefix(svc.Name, conf.ServicePrefix) {
+			services[svc.Namespace+"/"+svc.Name] = true
+			continue
+		}
+		kind, name := "Deployment", conf.WorkloadName(svc.Name)
+		if ref := metav1.GetControllerOf(&svc); ref != nil {
+			kind, name = ref.Kind, ref.Name
+		}
+		if workloads[kind+"/"+svc.Namespace+"/"+name] {
+			services[svc.Namespace+"/"+svc.Name] = true
+			continue
+		}
+
+		orphans = append(orphans, Orphan{Kind: "Service", Namespace: svc.Namespace, Name: svc.Name})
+		if err = c.delete(orphans[len(orphans)-1]); err != nil {
+			return
+		}
+	}
+
+	ings, err := c.ingressClient().List(metav1.NamespaceAll)
+	if err != nil {
+		return
+	}
+	for _, ing := range ings {
+		if c.isExcluded(ing.Namespace) || len(ing.Spec.Rules) == 0 || ing.Spec.Rules[0].HTTP == nil || len(ing.Spec.Rules[0].HTTP.Paths) == 0 {
+			continue
+		}
+		if ing.Spec.Rules[0].HTTP.Paths[0].Backend.Service == nil {
+			continue
+		}
+		sn := ing.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name
+		// Ingresses created before they were annotated are recognized by the
+		// service owning them, a name alone may be the one of an ingress of
+		// the user
+		ref := metav1.GetControllerOf(&ing)
+		if ing.Annotations["pigo.io/part-of"] != c.Policies.Config(ing.Namespace).PartOf && (ref == nil || ref.Kind != "Service") {
+			continue
+		}
+		if services[ing.Namespace+"/"+sn] {
+			continue
+		}
+
+		orphans = append(orphans, Orphan{Kind: "Ingress", Namespace: ing.Namespace, Name: ing.Name})
+		if err = c.delete(orphans[len(orphans)-1]); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// CollectRenamed deletes the services and ingresses still named after the
+// configuration old once their counterparts named after the current
+// configuration exist. It returns the deleted objects, and the number of the
+// ones still waiting for their counterpart.
+func (c *Collector) CollectRenamed(old *config.Config) (orphans []Orphan, pending int, err error) {
+	conf := c.Policies.Config("")
+
+	svcs, err := c.K8sClient.CoreV1().Services(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, 0, err
+	}
+	services := map[string]bool{}
+	for _, svc := range svcs.Items {
+		services[svc.Namespace+"/"+svc.Name] = true
+	}
+	ings, err := c.ingressClient().List(metav1.NamespaceAll)
+	if err != nil {
+		return nil, 0, err
+	}
+	// routed are the services the ingresses route to
+	routed := map[string]bool{}
+	for _, ing := range ings {
+		if len(ing.Spec.Rules) > 0 && ing.Spec.Rules[0].HTTP != nil && len(ing.Spec.Rules[0].HTTP.Paths) > 0 &&
+			ing.Spec.Rules[0].HTTP.Paths[0].Backend.Service != nil {
+			routed[ing.Namespace+"/"+ing.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name] = true
+		}
+	}
+	for _, svc := range svcs.Items {
+		if c.isExcluded(svc.Namespace) || svc.Annotations["pigo.io/part-of"] != old.PartOf || !strings.HasPrefix(svc.Name, old.ServicePrefix) {
+			continue
+		}
+		// The services already named after the current configuration are kept
+		if svc.Annotations["pigo.io/part-of"] == conf.PartOf && strings.HasPrefix(svc.Name, conf.ServicePrefix) {
+			continue
+		}
+		sn := conf.ServiceName(old.WorkloadName(svc.Name))
+		if sn == svc.Name {
+			continue
+		}
+		if !services[svc.Namespace+"/"+sn] {
+			pending++
+			continue
+		}
+		// The ingress is kept until the renamed service has taken it over or
+		// has its own
+		if routed[svc.Namespace+"/"+svc.Name] && !routed[svc.Namespace+"/"+sn] {
+			pending++
+			continue
+		}
+
+		// The ingress of the service is deleted along with it
+		orphans = append(orphans, Orphan{Kind: "Service", Namespace: svc.Namespace, Name: svc.Name})
+		if err = c.delete(orphans[len(orphans)-1]); err != nil {
+			return
+		}
+	}
+
+	ingresses := map[string]bool{}
+	for _, ing := range ings {
+		ingresses[ing.Namespace+"/"+ing.Name] = true
+	}
+	for _, ing := range ings {
+		if c.isExcluded(ing.Namespace) || len(ing.Spec.Rules) == 0 || ing.Spec.Rules[0].HTTP == nil || len(ing.Spec.Rules[0].HTTP.Paths) == 0 {
+			continue
+		}
+		if ing.Spec.Rules[0].HTTP.Paths[0].Backend.Service == nil {
+			continue
+		}
+		sn := ing.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name
+		// The ingresses of the renamed services are handled with them
+		if conf.ServiceName(old.WorkloadName(sn)) != sn {
+			continue
+		}
+		name := conf.IngressName(sn)
+		if ing.Name != old.IngressName(sn) || ing.Name == name {
+			continue
+		}
+		if !ingresses[ing.Namespace+"/"+name] {
+			pending++
+			continue
+		}
+
+		orphans = append(orphans, Orphan{Kind: "Ingress", Namespace: ing.Namespace, Name: ing.Name})
+		if err = c.delete(orphans[len(orphans)-1]); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (c *Collector) delete(o Orphan) (err error) {
+	if c.DryRun {
+		return
+	}
+
+	deletePolicy := metav1.DeletePropagationForeground
+	opts := metav1.DeleteOptions{PropagationPolicy: &deletePolicy}
+	switch o.Kind {
+	case "Service":
+		err = c.K8sClient.CoreV1().Services(o.Namespace).Delete(context.TODO(), o.Name, opts)
+	case "Ingress":
+		err = c.ingressClient().Delete(o.Namespace, o.Name, opts)
+	}
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("namespace", o.Namespace).
+			Str(strings.ToLower(o.Kind)+" name", o.Name).
+			Send()
+		return
+	}
+	log.Printf("%s %s/%s was COLLECTED", strings.ToUpper(o.Kind), o.Namespace, o.Name)
+
+	return
+}
+
+func (c *Collector) ingressClient() *ingress.Client {
+	return &ingress.Client{K8sClient: c.K8sClient, Version: c.IngressVersion}
+}
+
+func (c *Collector) isExcluded(ns string) bool {
+	return c.Policies.IsExcluded(ns)
+}
@@ -0,0 +1,230 @@
+package gc
+
+import (
+	"context"
+	"github.com/pinative/k8s-bot/pkg/config"
+	"github.com/pinative/k8s-bot/pkg/ingress"
+	"github.com/pinative/k8s-bot/pkg/policy"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+var testConfig = &config.Config{PartOf: "k8s.bot", ServicePrefix: "svc-", IngressPrefix: "ing-", Domain: ".apps.example.com", HostnameStrategy: "template"}
+
+func newFakeService(name string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: testConfig.ServicePrefix + name,
+			Namespace: "fake-test",
+			Annotations: map[string]string{"pigo.io/part-of": testConfig.PartOf},
+		},
+	}
+}
+
+func newFakeIngress(name string) *v1beta1.Ingress {
+	return &v1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: testConfig.IngressPrefix + name,
+			Namespace: "fake-test",
+			Annotations: map[string]string{"pigo.io/part-of": testConfig.PartOf},
+		},
+		Spec: v1beta1.IngressSpec{
+			Rules: []v1beta1.IngressRule{
+				{
+					IngressRuleValue: v1beta1.IngressRuleValue{
+						HTTP: &v1beta1.HTTPIngressRuleValue{
+							Paths: []v1beta1.HTTPIngressPath{
+								{
+									Backend: v1beta1.IngressBackend{
+										ServiceName: testConfig.ServicePrefix + name,
+										ServicePort: intstr.IntOrString{Type: intstr.Int, IntVal: 80},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func newFakeCollector(dryRun bool) *Collector {
+	d := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "fake-alive",
+			Namespace: "fake-test",
+		},
+	}
+
+	return &Collector{
+		K8sClient: fake.NewSimpleClientset(d,
+			newFakeService("fake-alive"), newFakeIngress("fake-alive"),
+			newFakeService("fake-orphan"), newFakeIngress("fake-orphan")),
+		Policies: policy.NewStore(testConfig),
+		DryRun: dryRun,
+		IngressVersion: ingress.NetworkingV1beta1,
+	}
+}
+
+func TestCollector_Collect(t *testing.T) {
+	c := newFakeCollector(false)
+
+	orphans, err := c.Collect()
+	if err != nil {
+		t.Errorf("Expected no errors occured to collect the orphans, but got error: %v", err)
+	}
+
+	if len(orphans) != 2 {
+		t.Errorf("Expected the orphan service and ingress to be collected, but got %v", orphans)
+	}
+
+	sl, _ := c.K8sClient.CoreV1().Services("fake-test").List(context.TODO(), metav1.ListOptions{})
+	if len(sl.Items) != 1 || sl.Items[0].Name != testConfig.ServicePrefix + "fake-alive" {
+		t.Errorf("Expected only the service of the alive deployment left, but got %v", sl.Items)
+	}
+
+	il, _ := c.K8sClient.NetworkingV1beta1().Ingresses("fake-test").List(context.TODO(), metav1.ListOptions{})
+	if len(il.Items) != 1 || il.Items[0].Name != testConfig.IngressPrefix + "fake-alive" {
+		t.Errorf("Expected only the ingress of the alive service left, but got %v", il.Items)
+	}
+}
+
+func TestCollector_CollectWithDryRun(t *testing.T) {
+	c := newFakeCollector(true)
+
+	orphans, err := c.Collect()
+	if err != nil {
+		t.Errorf("Expected no errors occured to collect the orphans, but got error: %v", err)
+	}
+
+	if len(orphans) != 2 {
+		t.Errorf("Expected the orphan service and ingress to be reported, but got %v", orphans)
+	}
+
+	sl, _ := c.K8sClient.CoreV1().Services("fake-test").List(context.TODO(), metav1.ListOptions{})
+	if len(sl.Items) != 2 {
+		t.Errorf("Expected no services deleted on dry run, but got %v services", len(sl.Items))
+	}
+}
+
+func TestCollector_CollectWithUserIngress(t *testing.T) {
+	// An ingress of the user named like the ones of the bot
+	ui := newFakeIngress("fake-user")
+	ui.Annotations = nil
+	// An ingress created before they were annotated, owned by its service
+	oi := newFakeIngress("fake-owned")
+	oi.Annotations = nil
+	oi.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(newFakeService("fake-owned"), corev1.SchemeGroupVersion.WithKind("Service"))}
+	c := &Collector{
+		K8sClient: fake.NewSimpleClientset(ui, oi),
+		Policies: policy.NewStore(testConfig),
+		IngressVersion: ingress.NetworkingV1beta1,
+	}
+
+	orphans, err := c.Collect()
+	if err != nil {
+		t.Errorf("Expected no errors occured to collect the orphans, but got error: %v", err)
+	}
+
+	if len(orphans) != 1 || orphans[0].Name != oi.Name {
+		t.Errorf("Expected only the ingress owned by its service to be collected, but got %v", orphans)
+	}
+}
+
+func TestCollector_CollectWithStatefulSet(t *testing.T) {
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "fake-db",
+			Namespace: "fake-test",
+			UID: "fake-sts-uid",
+		},
+	}
+	fs := newFakeService("fake-db")
+	fs.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(sts, appsv1.SchemeGroupVersion.WithKind("StatefulSet"))}
+	c := &Collector{
+		K8sClient: fake.NewSimpleClientset(sts, fs),
+		Policies: policy.NewStore(testConfig),
+		IngressVersion: ingress.NetworkingV1,
+	}
+
+	orphans, err := c.Collect()
+	if err != nil {
+		t.Errorf("Expected no errors occured to collect the orphans, but got error: %v", err)
+	}
+
+	if len(orphans) != 0 {
+		t.Errorf("Expected the service of the statefulset to be kept, but got %v", orphans)
+	}
+}
+
+func TestCollector_CollectRenamed(t *testing.T) {
+	conf := *testConfig
+	conf.ServicePrefix = "bot-"
+	renamed := newFakeService("fake-renamed")
+	renamed.Name = conf.ServicePrefix + "fake-renamed"
+	c := &Collector{
+		K8sClient: fake.NewSimpleClientset(
+			newFakeService("fake-renamed"), renamed,
+			newFakeService("fake-pending")),
+		Policies: policy.NewStore(&conf),
+		IngressVersion: ingress.NetworkingV1beta1,
+	}
+
+	orphans, pending, err := c.CollectRenamed(testConfig)
+	if err != nil {
+		t.Errorf("Expected no errors occured to collect the renamed objects, but got error: %v", err)
+	}
+
+	if len(orphans) != 1 || orphans[0].Name != testConfig.ServicePrefix + "fake-renamed" {
+		t.Errorf("Expected the service with the previous name to be collected, but got %v", orphans)
+	}
+	if pending != 1 {
+		t.Errorf("Expected the service without its counterpart to be pending, but got %d", pending)
+	}
+
+	sl, _ := c.K8sClient.CoreV1().Services("fake-test").List(context.TODO(), metav1.ListOptions{})
+	if len(sl.Items) != 2 {
+		t.Errorf("Expected the renamed and the pending services left, but got %v", sl.Items)
+	}
+}
+
+func TestCollector_CollectRenamedWithIngress(t *testing.T) {
+	conf := *testConfig
+	conf.ServicePrefix = "bot-"
+	renamed := newFakeService("fake-renamed")
+	renamed.Name = conf.ServicePrefix + "fake-renamed"
+	c := &Collector{
+		K8sClient: fake.NewSimpleClientset(newFakeService("fake-renamed"), renamed, newFakeIngress("fake-renamed")),
+		Policies: policy.NewStore(&conf),
+		IngressVersion: ingress.NetworkingV1beta1,
+	}
+
+	// The ingress still routes to the service with the previous name
+	orphans, pending, err := c.CollectRenamed(testConfig)
+	if err != nil {
+		t.Errorf("Expected no errors occured to collect the renamed objects, but got error: %v", err)
+	}
+	if len(orphans) != 0 || pending != 1 {
+		t.Errorf("Expected the service to be pending until its ingress is taken over, but got %v collected and %d pending", orphans, pending)
+	}
+
+	ing := newFakeIngress("fake-renamed")
+	ing.Spec.Rules[0].HTTP.Paths[0].Backend.ServiceName = renamed.Name
+	if _, err := c.K8sClient.NetworkingV1beta1().Ingresses(ing.Namespace).Update(context.TODO(), ing, metav1.UpdateOptions{}); err != nil {
+		t.Errorf("Expected no errors occured to update the ingress, but got error: %v", err)
+		return
+	}
+	orphans, pending, _ = c.CollectRenamed(testConfig)
+	if len(orphans) != 1 || orphans[0].Name != testConfig.ServicePrefix + "fake-renamed" || pending != 0 {
+		t.Errorf("Expected the service with the previous name to be collected once its ingress is taken over, but got %v collected and %d pending", orphans, pending)
+	}
+	if _, err := c.K8sClient.NetworkingV1beta1().Ingresses(ing.Namespace).Get(context.TODO(), ing.Name, metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected the ingress taken over to be kept, but got error: %v", err)
+	}
+}
@@ -3,9 +3,9 @@ package helper
 import (
 	"encoding/hex"
 	"encoding/json"
-	"github.com/joho/godotenv"
 	"github.com/rs/xid"
 	"github.com/rs/zerolog/log"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -25,6 +25,15 @@ func GetClientset() *kubernetes.Clientset {
 	}
 }
 
+// GetDynamicClient returns the client of the custom resources of the bot.
+func GetDynamicClient() dynamic.Interface {
+	client, err := dynamic.NewForConfig(getKubernetesConfig())
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+	return client
+}
+
 func GetRandomValue(n int32) string {
 	rand.Seed(time.Now().UnixNano())
 	b := make([]byte, n)
@@ -36,39 +45,15 @@ func GetRandomValue(n int32) string {
 	return hex.EncodeToString(b)
 }
 
-// AreNamespaceInExcludesList verifies if the provided label list
-// is in the provided whitelist and returns true, otherwise false.
-func AreNamespaceInExcludesList(namespace string, whitelist []string) bool {
-	for _, ns := range whitelist {
-		if ns == namespace {
-			return true
-		}
-	}
-	return false
-}
-
-func GetPublicDns() string {
-	d := os.Getenv("PUBLIC_DNS_DOMAIN")
-	if strings.HasPrefix(".", d) {
+// GetPublicDns returns a random hostname in the domain d.
+func GetPublicDns(d string) string {
+	if strings.HasPrefix(d, ".") {
 		return generateDNSPrefix() + d
 	}
 
 	return generateDNSPrefix() + "." + d
 }
 
-func LoadEnvVariables() {
-	p := os.Getenv("BOT_ENV_FILE_PATH")
-	if p != "" && !strings.HasSuffix(p, "/") {
-		p = p + "/"
-	}
-
-	err := godotenv.Load( p + ".env")
-
-	if err != nil {
-		log.Fatal().Msg("Error loading .env file")
-	}
-}
-
 func FormatJson(v interface{}) (formatted []byte) {
 	formatted, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
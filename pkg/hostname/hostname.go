@@ -0,0 +1,126 @@
+package hostname
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/pinative/k8s-bot/pkg/config"
+	"github.com/pinative/k8s-bot/pkg/helper"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+const (
+	// StrategyTemplate renders the hostname from a template, it is the default.
+	StrategyTemplate = "template"
+	// StrategyRandom generates a new random hostname for every ingress.
+	StrategyRandom = "random"
+
+	// DefaultTemplate is used when no hostname template is configured.
+	DefaultTemplate = "{{.Name}}.{{.Namespace}}.{{.Domain}}"
+
+	maxLabelLength = 63
+	maxNameLength  = 253
+	hashLength     = 8
+)
+
+var invalidChars = regexp.MustCompile("[^a-z0-9-]+")
+
+// Data is the data hostname templates are rendered with.
+type Data struct {
+	// Name of the deployment.
+	Name string
+	// Namespace of the deployment.
+	Namespace string
+	// Domain is the public DNS domain without leading dot.
+	Domain string
+}
+
+// Strategy returns the hostname strategy of the configuration c.
+func Strategy(c *config.Config) string {
+	if c.HostnameStrategy == StrategyRandom {
+		return StrategyRandom
+	}
+
+	return StrategyTemplate
+}
+
+// New returns the hostname of the deployment name in namespace ns with the
+// configuration c. The annotation, when not empty, overrides the template of
+// the configuration.
+func New(c *config.Config, annotation, name, ns string) (string, error) {
+	if annotation == "" && Strategy(c) == StrategyRandom {
+		return helper.GetPublicDns(c.Domain), nil
+	}
+
+	tmpl := annotation
+	if tmpl == "" {
+		tmpl = c.HostnameTemplate
+	}
+	if tmpl == "" {
+		tmpl = DefaultTemplate
+	}
+
+	t, err := template.New("hostname").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = t.Execute(&buf, Data{
+		Name:      name,
+		Namespace: ns,
+		Domain:    strings.TrimPrefix(c.Domain, "."),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return Sanitize(buf.String()), nil
+}
+
+// Sanitize turns h into a valid DNS-1123 subdomain, every label longer than
+// 63 characters is truncated with a hash suffix to keep it unique.
+func Sanitize(h string) string {
+	var ls []string
+	for _, l := range strings.Split(strings.ToLower(h), ".") {
+		l = strings.Trim(invalidChars.ReplaceAllString(l, "-"), "-")
+		if l == "" {
+			continue
+		}
+		if len(l) > maxLabelLength {
+			sum := sha256.Sum256([]byte(l))
+			l = strings.TrimRight(l[:maxLabelLength-hashLength-1], "-") + "-" + hex.EncodeToString(sum[:])[:hashLength]
+		}
+		ls = append(ls, l)
+	}
+
+	h = strings.Join(ls, ".")
+	if len(h) <= maxNameLength {
+		return h
+	}
+
+	// The leading labels are shortened into a single one with a hash suffix,
+	// the domain is kept.
+	sum := sha256.Sum256([]byte(h))
+	suffix := hex.EncodeToString(sum[:])[:hashLength]
+	for len(ls) > 1 && len(strings.Join(ls[1:], "."))+hashLength+1 > maxNameLength {
+		ls = ls[1:]
+	}
+	rest := strings.Join(ls[1:], ".")
+	keep := maxNameLength - len(rest) - 1 - hashLength - 1
+	if keep > len(ls[0]) {
+		keep = len(ls[0])
+	}
+	first := suffix
+	if keep > 0 {
+		if l := strings.TrimRight(ls[0][:keep], "-"); l != "" {
+			first = l + "-" + suffix
+		}
+	}
+	if rest == "" {
+		return first
+	}
+
+	return first + "." + rest
+}
@@ -0,0 +1,72 @@
+package hostname
+
+import (
+	"github.com/pinative/k8s-bot/pkg/config"
+	"strings"
+	"testing"
+)
+
+var testConfig = &config.Config{Domain: ".apps.example.com", HostnameStrategy: StrategyTemplate}
+
+func TestNewWithDefaultTemplate(t *testing.T) {
+	h, err := New(testConfig, "", "html-edge", "fake-test")
+	if err != nil {
+		t.Errorf("Expected no errors occured to render the hostname, but got error: %v", err)
+	}
+
+	if h != "html-edge.fake-test.apps.example.com" {
+		t.Errorf("Expected the hostname to be html-edge.fake-test.apps.example.com, but got %s", h)
+	}
+}
+
+func TestNewWithAnnotation(t *testing.T) {
+	h, err := New(testConfig, "{{.Name}}-Preview.{{.Domain}}", "html_edge", "fake-test")
+	if err != nil {
+		t.Errorf("Expected no errors occured to render the hostname, but got error: %v", err)
+	}
+
+	if h != "html-edge-preview.apps.example.com" {
+		t.Errorf("Expected the hostname to be html-edge-preview.apps.example.com, but got %s", h)
+	}
+}
+
+func TestNewWithInvalidTemplate(t *testing.T) {
+	_, err := New(testConfig, "{{.Unknown}}.{{.Domain}}", "html-edge", "fake-test")
+	if err == nil {
+		t.Errorf("Expected an error to be returned for an unknown template field, but did not.")
+	}
+}
+
+func TestSanitizeWithLongName(t *testing.T) {
+	l := strings.Repeat(strings.Repeat("a", 60) + ".", 5)
+	h := Sanitize(l + "apps.example.com")
+
+	if len(h) > maxNameLength {
+		t.Errorf("Expected the hostname to be truncated to %v characters, but got %v", maxNameLength, len(h))
+	}
+	if !strings.HasSuffix(h, ".apps.example.com") {
+		t.Errorf("Expected the domain to be kept, but got %s", h)
+	}
+	for _, l := range strings.Split(h, ".") {
+		if len(l) > maxLabelLength {
+			t.Errorf("Expected the labels to be at most %v characters, but got %s", maxLabelLength, l)
+		}
+	}
+	if Sanitize("b" + l + "apps.example.com") == h {
+		t.Errorf("Expected truncated hostnames to be kept unique by the hash suffix, but got %s twice", h)
+	}
+}
+
+func TestSanitizeWithLongLabel(t *testing.T) {
+	l := strings.Repeat("a", 70)
+	h := Sanitize(l + ".apps.example.com")
+
+	labels := strings.Split(h, ".")
+	if len(labels[0]) != maxLabelLength {
+		t.Errorf("Expected the label to be truncated to %v characters, but got %v", maxLabelLength, len(labels[0]))
+	}
+
+	if Sanitize(l + "b.apps.example.com") == h {
+		t.Errorf("Expected truncated labels to be kept unique by the hash suffix, but got %s twice", h)
+	}
+}
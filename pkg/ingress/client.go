@@ -0,0 +1,291 @@
+package ingress
+
+import (
+	"context"
+	networkingv1 "k8s.io/api/networking/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// APIVersion is the API version the ingresses are served with.
+type APIVersion string
+
+const (
+	// NetworkingV1 is served by Kubernetes 1.19+, it is the default.
+	NetworkingV1 APIVersion = "networking.k8s.io/v1"
+	// NetworkingV1beta1 is served by Kubernetes up to 1.21.
+	NetworkingV1beta1 APIVersion = "networking.k8s.io/v1beta1"
+
+	// ingressClassAnnotation is read by the ingress controllers predating the
+	// ingressClassName field, it replaces the field on networking.k8s.io/v1beta1.
+	ingressClassAnnotation = "kubernetes.io/ingress.class"
+)
+
+// DetectAPIVersion returns networking.k8s.io/v1 when the cluster serves the
+// ingresses with it, and falls back to networking.k8s.io/v1beta1 otherwise.
+func DetectAPIVersion(client kubernetes.Interface) (APIVersion, error) {
+	groups, err := client.Discovery().ServerGroups()
+	if err != nil {
+		return "", err
+	}
+	for _, g := range groups.Groups {
+		for _, gv := range g.Versions {
+			if gv.GroupVersion != string(NetworkingV1) {
+				continue
+			}
+			resources, err := client.Discovery().ServerResourcesForGroupVersion(gv.GroupVersion)
+			if err != nil {
+				return "", err
+			}
+			for _, r := range resources.APIResources {
+				if r.Name == "ingresses" {
+					return NetworkingV1, nil
+				}
+			}
+		}
+	}
+
+	return NetworkingV1beta1, nil
+}
+
+// Informer returns the shared informer of the ingresses served with v.
+func Informer(f informers.SharedInformerFactory, v APIVersion) cache.SharedIndexInformer {
+	if v == NetworkingV1beta1 {
+		return f.Networking().V1beta1().Ingresses().Informer()
+	}
+
+	return f.Networking().V1().Ingresses().Informer()
+}
+
+// A Lister lists the ingresses cached by the shared informer of their API
+// version as networking.k8s.io/v1 objects.
+type Lister interface {
+	// List lists the ingresses of the namespace ns, or of the whole cluster
+	// when ns is empty.
+	List(ns string) ([]*networkingv1.Ingress, error)
+}
+
+// NewLister returns the Lister of the ingresses served with v.
+func NewLister(f informers.SharedInformerFactory, v APIVersion) Lister {
+	return &lister{factory: f, version: v}
+}
+
+type lister struct {
+	factory informers.SharedInformerFactory
+	version APIVersion
+}
+
+func (l *lister) List(ns string) (ret []*networkingv1.Ingress, err error) {
+	if l.version != NetworkingV1beta1 {
+		il := l.factory.Networking().V1().Ingresses().Lister()
+		if ns == "" {
+			return il.List(labels.Everything())
+		}
+		return il.Ingresses(ns).List(labels.Everything())
+	}
+
+	var ingresses []*networkingv1beta1.Ingress
+	il := l.factory.Networking().V1beta1().Ingresses().Lister()
+	if ns == "" {
+		ingresses, err = il.List(labels.Everything())
+	} else {
+		ingresses, err = il.Ingresses(ns).List(labels.Everything())
+	}
+	for _, ing := range ingresses {
+		ret = append(ret, toV1(ing))
+	}
+
+	return
+}
+
+// A Client reads and writes the ingresses as networking.k8s.io/v1 objects
+// with the API version served by the cluster.
+type Client struct {
+	K8sClient kubernetes.Interface
+	Version   APIVersion
+}
+
+func (c *Client) Get(ns, name string) (*networkingv1.Ingress, error) {
+	if c.Version == NetworkingV1beta1 {
+		ing, err := c.K8sClient.NetworkingV1beta1().Ingresses(ns).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return toV1(ing), nil
+	}
+
+	return c.K8sClient.NetworkingV1().Ingresses(ns).Get(context.TODO(), name, metav1.GetOptions{})
+}
+
+func (c *Client) List(ns string) ([]networkingv1.Ingress, error) {
+	if c.Version == NetworkingV1beta1 {
+		l, err := c.K8sClient.NetworkingV1beta1().Ingresses(ns).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		ret := make([]networkingv1.Ingress, len(l.Items))
+		for i := range l.Items {
+			ret[i] = *toV1(&l.Items[i])
+		}
+		return ret, nil
+	}
+
+	l, err := c.K8sClient.NetworkingV1().Ingresses(ns).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return l.Items, nil
+}
+
+func (c *Client) Create(ing *networkingv1.Ingress) (err error) {
+	if c.Version == NetworkingV1beta1 {
+		_, err = c.K8sClient.NetworkingV1beta1().Ingresses(ing.Namespace).Create(context.TODO(), toV1beta1(ing), metav1.CreateOptions{})
+		return
+	}
+
+	_, err = c.K8sClient.NetworkingV1().Ingresses(ing.Namespace).Create(context.TODO(), ing, metav1.CreateOptions{})
+	return
+}
+
+func (c *Client) Update(ing *networkingv1.Ingress) (err error) {
+	if c.Version == NetworkingV1beta1 {
+		_, err = c.K8sClient.NetworkingV1beta1().Ingresses(ing.Namespace).Update(context.TODO(), toV1beta1(ing), metav1.UpdateOptions{})
+		return
+	}
+
+	_, err = c.K8sClient.NetworkingV1().Ingresses(ing.Namespace).Update(context.TODO(), ing, metav1.UpdateOptions{})
+	return
+}
+
+// Patch patches the ingress, the patch must be valid for both API versions,
+// e.g. only patch the metadata.
+func (c *Client) Patch(ns, name string, pt types.PatchType, data []byte) (err error) {
+	if c.Version == NetworkingV1beta1 {
+		_, err = c.K8sClient.NetworkingV1beta1().Ingresses(ns).Patch(context.TODO(), name, pt, data, metav1.PatchOptions{})
+		return
+	}
+
+	_, err = c.K8sClient.NetworkingV1().Ingresses(ns).Patch(context.TODO(), name, pt, data, metav1.PatchOptions{})
+	return
+}
+
+func (c *Client) Delete(ns, name string, opts metav1.DeleteOptions) error {
+	if c.Version == NetworkingV1beta1 {
+		return c.K8sClient.NetworkingV1beta1().Ingresses(ns).Delete(context.TODO(), name, opts)
+	}
+
+	return c.K8sClient.NetworkingV1().Ingresses(ns).Delete(context.TODO(), name, opts)
+}
+
+// toV1 converts a networking.k8s.io/v1beta1 ingress into networking.k8s.io/v1.
+func toV1(in *networkingv1beta1.Ingress) *networkingv1.Ingress {
+	out := &networkingv1.Ingress{
+		TypeMeta:   metav1.TypeMeta{APIVersion: string(NetworkingV1), Kind: "Ingress"},
+		ObjectMeta: *in.ObjectMeta.DeepCopy(),
+		Spec: networkingv1.IngressSpec{
+			IngressClassName: in.Spec.IngressClassName,
+		},
+		Status: networkingv1.IngressStatus{LoadBalancer: *in.Status.LoadBalancer.DeepCopy()},
+	}
+	if c, ok := out.Annotations[ingressClassAnnotation]; ok && out.Spec.IngressClassName == nil {
+		out.Spec.IngressClassName = &c
+		delete(out.Annotations, ingressClassAnnotation)
+	}
+	if in.Spec.Backend != nil {
+		b := toV1Backend(*in.Spec.Backend)
+		out.Spec.DefaultBackend = &b
+	}
+	for _, t := range in.Spec.TLS {
+		out.Spec.TLS = append(out.Spec.TLS, networkingv1.IngressTLS{Hosts: t.Hosts, SecretName: t.SecretName})
+	}
+	for _, r := range in.Spec.Rules {
+		rule := networkingv1.IngressRule{Host: r.Host}
+		if r.HTTP != nil {
+			rule.HTTP = &networkingv1.HTTPIngressRuleValue{}
+			for _, p := range r.HTTP.Paths {
+				rule.HTTP.Paths = append(rule.HTTP.Paths, networkingv1.HTTPIngressPath{
+					Path:     p.Path,
+					PathType: (*networkingv1.PathType)(p.PathType),
+					Backend:  toV1Backend(p.Backend),
+				})
+			}
+		}
+		out.Spec.Rules = append(out.Spec.Rules, rule)
+	}
+
+	return out
+}
+
+func toV1Backend(in networkingv1beta1.IngressBackend) (out networkingv1.IngressBackend) {
+	out.Resource = in.Resource
+	if in.ServiceName == "" {
+		return
+	}
+	out.Service = &networkingv1.IngressServiceBackend{Name: in.ServiceName}
+	if in.ServicePort.Type == intstr.String {
+		out.Service.Port.Name = in.ServicePort.StrVal
+	} else {
+		out.Service.Port.Number = in.ServicePort.IntVal
+	}
+
+	return
+}
+
+// toV1beta1 converts a networking.k8s.io/v1 ingress into networking.k8s.io/v1beta1.
+func toV1beta1(in *networkingv1.Ingress) *networkingv1beta1.Ingress {
+	out := &networkingv1beta1.Ingress{
+		TypeMeta:   metav1.TypeMeta{APIVersion: string(NetworkingV1beta1), Kind: "Ingress"},
+		ObjectMeta: *in.ObjectMeta.DeepCopy(),
+		Status: networkingv1beta1.IngressStatus{LoadBalancer: *in.Status.LoadBalancer.DeepCopy()},
+	}
+	if in.Spec.IngressClassName != nil {
+		if out.Annotations == nil {
+			out.Annotations = map[string]string{}
+		}
+		out.Annotations[ingressClassAnnotation] = *in.Spec.IngressClassName
+	}
+	if in.Spec.DefaultBackend != nil {
+		b := toV1beta1Backend(*in.Spec.DefaultBackend)
+		out.Spec.Backend = &b
+	}
+	for _, t := range in.Spec.TLS {
+		out.Spec.TLS = append(out.Spec.TLS, networkingv1beta1.IngressTLS{Hosts: t.Hosts, SecretName: t.SecretName})
+	}
+	for _, r := range in.Spec.Rules {
+		rule := networkingv1beta1.IngressRule{Host: r.Host}
+		if r.HTTP != nil {
+			rule.HTTP = &networkingv1beta1.HTTPIngressRuleValue{}
+			for _, p := range r.HTTP.Paths {
+				rule.HTTP.Paths = append(rule.HTTP.Paths, networkingv1beta1.HTTPIngressPath{
+					Path:     p.Path,
+					PathType: (*networkingv1beta1.PathType)(p.PathType),
+					Backend:  toV1beta1Backend(p.Backend),
+				})
+			}
+		}
+		out.Spec.Rules = append(out.Spec.Rules, rule)
+	}
+
+	return out
+}
+
+func toV1beta1Backend(in networkingv1.IngressBackend) (out networkingv1beta1.IngressBackend) {
+	out.Resource = in.Resource
+	if in.Service == nil {
+		return
+	}
+	out.ServiceName = in.Service.Name
+	if in.Service.Port.Name != "" {
+		out.ServicePort = intstr.FromString(in.Service.Port.Name)
+	} else {
+		out.ServicePort = intstr.FromInt(int(in.Service.Port.Number))
+	}
+
+	return
+}
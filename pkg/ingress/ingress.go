@@ -1,19 +1,20 @@
 package ingress
 
 import (
-	"encoding/json"
-	"github.com/pinative/k8s-bot/pkg/helper"
+	"errors"
+	"fmt"
+	"github.com/pinative/k8s-bot/pkg/config"
+	"github.com/pinative/k8s-bot/pkg/hostname"
 	"github.com/pinative/k8s-bot/pkg/service"
 	"github.com/rs/zerolog/log"
 	corev1 "k8s.io/api/core/v1"
-	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/intstr"
-	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
-	"os"
+	"k8s.io/client-go/tools/record"
+	"reflect"
+	"sort"
 	"strings"
 )
 
@@ -21,119 +22,342 @@ type Ingress struct {
 	ServiceName string
 	Namespace string
 	K8sClient kubernetes.Interface
+	// Config is the configuration of the namespace of the ingress.
+	Config *config.Config
+	// Version is the API version the ingresses are written with, it defaults
+	// to networking.k8s.io/v1.
+	Version APIVersion
+	// Lister lists the ingresses of the cluster, it is required by UpsertIngress
+	// and no host conflict is detected when it is nil.
+	Lister Lister
+	// Recorder records the events on the workload of the service.
+	Recorder record.EventRecorder
+	// Workloads lists the workloads of the services, their status is not
+	// recorded when it is nil.
+	Workloads *service.WorkloadListers
 }
 
-func (i *Ingress) UpsertIngress(newSvc *corev1.Service, oldSvc *corev1.Service, iif informers.SharedInformerFactory) (err error) {
-	annots := newSvc.GetAnnotations()
+// A HostConflictError is returned when the host and path of an ingress are
+// already routed by an ingress which is not owned by the same service.
+type HostConflictError struct {
+	Host      string
+	Path      string
+	Namespace string
+	Name      string
+}
+
+func (e *HostConflictError) Error() string {
+	return fmt.Sprintf("host %s%s is already used by ingress %s/%s", e.Host, e.Path, e.Namespace, e.Name)
+}
+
+// UpsertIngress creates the ingress of a bot managed service exposed to the
+// internet, or points the existing one to the current service port. The
+// ingress of a service no longer exposed is deleted.
+func (i *Ingress) UpsertIngress(svc *corev1.Service) (err error) {
+	annots := svc.GetAnnotations()
 	aia := annots["pigo.network/allow-internet-access"]
-	if annots["pigo.io/part-of"] == os.Getenv("ANNOT_PIGO_IO_PARTOF") && aia == "true" {
-		var (
-			ingresses []*networkingv1beta1.Ingress
-			err error
-			on string
-			oss corev1.ServiceSpec
-
-			nn string
-			nns string
-			nss corev1.ServiceSpec
-		)
-		if oldSvc != nil {
-			ingresses, err = getIngresses(oldSvc.Name, oldSvc.Namespace, iif)
-			on = oldSvc.Name
-			oss = oldSvc.Spec
-		} else if newSvc != nil {
-			ingresses, err = getIngresses(newSvc.Name, newSvc.Namespace, iif)
-			nn = newSvc.Name
-			nns = newSvc.Namespace
-			nss = newSvc.Spec
-		}
-		if err != nil {
-			return err
+	if annots["pigo.io/part-of"] != i.Config.PartOf {
+		return
+	}
+	if aia != "true" {
+		return i.withdrawIngress(svc)
+	}
+	// The service named after a former prefix is replaced by the one of the
+	// current prefix, which takes its ingress over
+	if !strings.HasPrefix(svc.Name, i.Config.ServicePrefix) {
+		return
+	}
+	if i.Lister == nil {
+		return errors.New("invalid arguments, the ingress lister should not be nil")
+	}
+
+	ingresses, err := i.Lister.List(svc.Namespace)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error to list ingresses from namespace %s", svc.Namespace)
+		return err
+	}
+
+	// The ingress named after a former prefix is replaced by one under the
+	// current name, the former is collected once it is replaced
+	ingName := i.Config.IngressName(svc.Name)
+	if cur := getIngress(svc.Name, ingresses); cur != nil && cur.Name != ingName && metav1.IsControlledBy(cur, svc) {
+		named := getIngressByName(ingName, ingresses)
+		if named == nil {
+			return i.renameIngress(svc, cur)
 		}
+		ingresses = []*networkingv1.Ingress{named}
+	}
 
-		isExisted := HasIngressExists(on, ingresses)
-		if isExisted {
-			// If the service name or service port has been changed
-			//  then update corresponding ingress if it exists
-			osp := service.GetServicePort(on, oss.Ports)
-			nsp := service.GetServicePort(nn, nss.Ports)
-			if on != nn ||
-				(osp != 0 && nsp != 0 && osp != nsp) {
-				err = i.UpdateIngress(ingresses, on, nn, nns, nsp)
+	if !HasIngressExists(svc.Name, ingresses) {
+		// The ingress of the service renamed after a former service prefix
+		// already has the name of the ingress
+		if named := getIngressByName(ingName, ingresses); named != nil {
+			if !isRenamedIngress(i.Config, named) {
+				i.event(svc, corev1.EventTypeWarning, "FailedCreateIngress", "Ingress %s was not created: it already exists for another service", ingName)
+				return fmt.Errorf("ingress %s/%s already exists for another service", svc.Namespace, ingName)
 			}
-		} else {
-			err = i.CreateIngress(nn, nns, nss.Ports)
+			return i.adoptIngress(svc, named)
 		}
+		return i.CreateIngress(svc)
 	}
 
-	return
+	// If the service port, the hostname or the ingress class has been changed
+	// then update the corresponding ingress
+	nsp := service.GetIngressPortName(i.Config, svc)
+	h, err := getDesiredHost(i.Config, svc, ingresses)
+	if err != nil {
+		i.event(svc, corev1.EventTypeWarning, "FailedUpdateIngress", "Ingress %s was not updated: %v", ingName, err)
+		return err
+	}
+	if h != "" {
+		if err = i.checkHostConflict(svc, h); err != nil {
+			return err
+		}
+	}
+	c := getIngressClass(i.Config, svc)
+	if c == getIngressClassName(svc.Name, ingresses) {
+		c = ""
+	}
+	if nsp == getIngressServicePort(svc.Name, ingresses).Name {
+		nsp = ""
+	}
+	// The TLS follows the configuration, the service and the host
+	tls := tlsDrifted(i.Config, svc, getIngress(svc.Name, ingresses), h)
+	if nsp != "" || h != "" || c != "" || tls {
+		if err = i.updateIngress(ingresses, svc.Name, svc.Name, svc.Namespace, h, c, nsp, svc); err != nil {
+			i.event(svc, corev1.EventTypeWarning, "FailedUpdateIngress", "Ingress %s was not updated: %v", ingName, err)
+			return
+		}
+		var changes []string
+		for k, v := range map[string]string{"host": h, "ingress class": c, "service port": nsp} {
+			if v != "" {
+				changes = append(changes, k+" "+v)
+			}
+		}
+		if tls {
+			changes = append(changes, "TLS")
+		}
+		sort.Strings(changes)
+		i.event(svc, corev1.EventTypeNormal, "UpdatedIngress", "Ingress %s was updated: %s", ingName, strings.Join(changes, ", "))
+	}
+
+	return i.patchStatus(svc, ingName, ingressURL(getIngress(svc.Name, ingresses), h))
 }
 
-func (i *Ingress) CreateIngress(sn, ns string, sp []corev1.ServicePort) (err error) {
-	ing := newIngress(helper.GetPublicDns(), sn, ns, sp)
-	_, err = i.K8sClient.NetworkingV1beta1().Ingresses(ns).Create(ing)
+func (i *Ingress) CreateIngress(svc *corev1.Service) (err error) {
+	ns := svc.Namespace
+	if service.GetIngressPortName(i.Config, svc) == "" {
+		log.Warn().
+			Str("namespace", ns).
+			Str("service name", svc.Name).
+			Msg("no service port to route the ingress to")
+		i.event(svc, corev1.EventTypeWarning, "NoIngressPort",
+			"Ingress %s was not created: the service %s has no port to route to, see the pigo.network/port annotation", i.Config.IngressName(svc.Name), svc.Name)
+		// The workload is not exposed by the refused ingress
+		return i.patchStatus(svc, i.Config.IngressName(svc.Name), "")
+	}
+	h, err := newHostname(i.Config, svc)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("namespace", ns).
+			Str("service name", svc.Name).
+			Msg("render hostname")
+		i.event(svc, corev1.EventTypeWarning, "FailedCreateIngress", "Ingress %s was not created: %v", i.Config.IngressName(svc.Name), err)
+		return err
+	}
+	if err = i.checkHostConflict(svc, h); err != nil {
+		// The workload is not exposed by the refused ingress, the conflict is
+		// retried anyway
+		_ = i.patchStatus(svc, i.Config.IngressName(svc.Name), "")
+		return err
+	}
+	ing := newIngress(i.Config, h, svc)
+	err = i.client().Create(ing)
+	if k8serrors.IsAlreadyExists(err) {
+		return
+	}
 	if err != nil {
 		log.Error().
 			Err(err).
 			Str("namespace", ns).
 			Str("ingress name", ing.Name).
 			Send()
+		i.event(svc, corev1.EventTypeWarning, "FailedCreateIngress", "Ingress %s was not created: %v", ing.Name, err)
+		return
 	}
+	i.event(svc, corev1.EventTypeNormal, "CreatedIngress", "Ingress %s was created for the host %s", ing.Name, h)
 
-	return
+	return i.patchStatus(svc, ing.Name, ingressURL(ing, ""))
 }
 
-func (i *Ingress) UpdateIngress(ingresses []*networkingv1beta1.Ingress, osn, nsn, ns string, nsp int32) (err error) {
-	ingName := getIngressName(osn)
-	ingress := networkingv1beta1.Ingress{
-		ObjectMeta: metav1.ObjectMeta{Name: ingName},
-		Spec: networkingv1beta1.IngressSpec{
-			Rules: []networkingv1beta1.IngressRule{
-				{
-					IngressRuleValue: networkingv1beta1.IngressRuleValue{
-						HTTP: &networkingv1beta1.HTTPIngressRuleValue{
-							Paths: []networkingv1beta1.HTTPIngressPath{
-								{
-									Backend: networkingv1beta1.IngressBackend{},
-								},
-							},
-						},
-					},
-				},
-			},
-		},
+// renameIngress creates the ingress of svc under its current name from the
+// ingress old named after a former prefix. The host is kept, the ingress old
+// is deleted by the garbage collector once it is replaced.
+func (i *Ingress) renameIngress(svc *corev1.Service, old *networkingv1.Ingress) (err error) {
+	ing := old.DeepCopy()
+	ing.ObjectMeta = metav1.ObjectMeta{
+		Name:            i.Config.IngressName(svc.Name),
+		Namespace:       old.Namespace,
+		Labels:          old.Labels,
+		Annotations:     old.Annotations,
+		OwnerReferences: old.OwnerReferences,
 	}
-	for _, ing := range ingresses {
-		if ing.Spec.Rules[0].HTTP.Paths[0].Backend.ServiceName == osn {
-			if nsn != "" {
-				ingress.Spec.Rules[0].HTTP.Paths[0].Backend.ServiceName = nsn
-			}
+	if len(ing.Spec.Rules) > 0 {
+		setTLS(i.Config, svc, ing, ing.Spec.Rules[0].Host)
+	}
+	err = i.client().Create(ing)
+	if k8serrors.IsAlreadyExists(err) {
+		return nil
+	}
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("namespace", ing.Namespace).
+			Str("ingress name", ing.Name).
+			Send()
+		i.event(svc, corev1.EventTypeWarning, "FailedCreateIngress", "Ingress %s was not created: %v", ing.Name, err)
+		return
+	}
+	i.event(svc, corev1.EventTypeNormal, "RenamedIngress", "Ingress %s was renamed to %s", old.Name, ing.Name)
 
-			if nsp != 0 {
-				ingress.Spec.Rules[0].HTTP.Paths[0].Backend.ServicePort = intstr.IntOrString{Type: intstr.Int, IntVal: nsp}
-			}
-			break
+	return i.patchStatus(svc, ing.Name, ingressURL(ing, ""))
+}
+
+// adoptIngress points the ingress ing of a service renamed after a former
+// service prefix to the service svc, which owns it from then on.
+func (i *Ingress) adoptIngress(svc *corev1.Service, ing *networkingv1.Ingress) (err error) {
+	osn := getBackendServiceName(ing.Spec.Rules[0].HTTP.Paths[0])
+	ing = ing.DeepCopy()
+	path := &ing.Spec.Rules[0].HTTP.Paths[0]
+	path.Backend.Service.Name = svc.Name
+	if nsp := service.GetIngressPortName(i.Config, svc); nsp != "" {
+		path.Backend.Service.Port = networkingv1.ServiceBackendPort{Name: nsp}
+	}
+	var refs []metav1.OwnerReference
+	for _, ref := range ing.OwnerReferences {
+		if ref.Controller == nil || !*ref.Controller {
+			refs = append(refs, ref)
 		}
 	}
+	ing.OwnerReferences = append(refs, *NewOwnerReference(svc))
+	setTLS(i.Config, svc, ing, ing.Spec.Rules[0].Host)
 
-	if nsn != "" {
-		ij, err := json.Marshal(ingress)
-		if err != nil {
-			log.Error().
-				Err(err).
-				Str("namespace", ns).
-				Str("ingress name", ingName).
-				Msg("marshal ingress")
+	if err = i.client().Update(ing); err != nil {
+		log.Error().
+			Err(err).
+			Str("namespace", ing.Namespace).
+			Str("ingress name", ing.Name).
+			Msg("adopt ingress")
+		i.event(svc, corev1.EventTypeWarning, "FailedUpdateIngress", "Ingress %s was not updated: %v", ing.Name, err)
+		return
+	}
+	i.event(svc, corev1.EventTypeNormal, "AdoptedIngress", "Ingress %s was taken over from the service %s", ing.Name, osn)
+
+	return i.patchStatus(svc, ing.Name, ingressURL(ing, ""))
+}
+
+// withdrawIngress deletes the ingresses the service svc no longer exposed to the
+// internet controls, and removes their url from the status of its workload.
+func (i *Ingress) withdrawIngress(svc *corev1.Service) (err error) {
+	if i.Lister == nil {
+		return
+	}
+	ingresses, err := i.Lister.List(svc.Namespace)
+	if err != nil {
+		log.Error().Err(err).Msgf("Error to list ingresses from namespace %s", svc.Namespace)
+		return err
+	}
+
+	deletePolicy := metav1.DeletePropagationForeground
+	for _, ing := range ingresses {
+		if !metav1.IsControlledBy(ing, svc) {
+			continue
 		}
-		_, err = i.K8sClient.NetworkingV1beta1().Ingresses(ns).Patch(ingName, types.StrategicMergePatchType, ij)
-		if err != nil {
+		err = i.client().Delete(ing.Namespace, ing.Name, metav1.DeleteOptions{
+			PropagationPolicy: &deletePolicy,
+		})
+		if err != nil && !k8serrors.IsNotFound(err) {
 			log.Error().
 				Err(err).
-				Str("namespace", ns).
-				Str("ingress name", ingName).
-				Msgf("patch ingress %v", string(ij))
+				Str("namespace", ing.Namespace).
+				Str("ingress name", ing.Name).
+				Msg("withdraw ingress")
+			i.event(svc, corev1.EventTypeWarning, "FailedDeleteIngress", "Ingress %s of the service %s no longer exposed was not deleted: %v", ing.Name, svc.Name, err)
+			return
+		}
+		i.event(svc, corev1.EventTypeNormal, "DeletedIngress", "Ingress %s was deleted, the service %s is no longer exposed", ing.Name, svc.Name)
+		if err = i.patchStatus(svc, ing.Name, ""); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// isRenamedIngress returns true if the ingress ing managed by the bot routes to
+// a service it is not named after, the service was renamed since.
+func isRenamedIngress(conf *config.Config, ing *networkingv1.Ingress) bool {
+	if ing.Annotations["pigo.io/part-of"] != conf.PartOf || len(ing.Spec.Rules) == 0 || ing.Spec.Rules[0].HTTP == nil ||
+		len(ing.Spec.Rules[0].HTTP.Paths) == 0 || ing.Spec.Rules[0].HTTP.Paths[0].Backend.Service == nil {
+		return false
+	}
+	if ref := metav1.GetControllerOf(ing); ref == nil || ref.Kind != "Service" {
+		return false
+	}
+
+	return conf.IngressName(getBackendServiceName(ing.Spec.Rules[0].HTTP.Paths[0])) != ing.Name
+}
+
+// UpdateIngress points the ingress of the service osn to the service nsn on
+// the port named nsp, moves it to the host h unless h is empty and to the ingress class
+// c unless c is empty.
+func (i *Ingress) UpdateIngress(ingresses []*networkingv1.Ingress, osn, nsn, ns, h, c, nsp string) (err error) {
+	return i.updateIngress(ingresses, osn, nsn, ns, h, c, nsp, nil)
+}
+
+// updateIngress updates the ingress like UpdateIngress, the TLS of the
+// ingress is set to the one of the service svc as well unless svc is nil.
+func (i *Ingress) updateIngress(ingresses []*networkingv1.Ingress, osn, nsn, ns, h, c, nsp string, svc *corev1.Service) (err error) {
+	ingName := i.Config.IngressName(osn)
+	ingress := getIngress(osn, ingresses)
+	if ingress == nil || nsn == "" {
+		return
+	}
+	ingress = ingress.DeepCopy()
+
+	path := &ingress.Spec.Rules[0].HTTP.Paths[0]
+	if h != "" {
+		// The certificate follows the host
+		for _, t := range ingress.Spec.TLS {
+			for j := range t.Hosts {
+				if t.Hosts[j] == ingress.Spec.Rules[0].Host {
+					t.Hosts[j] = h
+				}
+			}
 		}
+		ingress.Spec.Rules[0].Host = h
+	}
+	if c != "" {
+		ingress.Spec.IngressClassName = &c
+	}
+	if path.Backend.Service == nil {
+		path.Backend.Service = &networkingv1.IngressServiceBackend{}
+	}
+	path.Backend.Service.Name = nsn
+	if nsp != "" {
+		path.Backend.Service.Port = networkingv1.ServiceBackendPort{Name: nsp}
+	}
+	if svc != nil {
+		setTLS(i.Config, svc, ingress, ingress.Spec.Rules[0].Host)
+	}
 
+	err = i.client().Update(ingress)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("namespace", ns).
+			Str("ingress name", ingName).
+			Msg("update ingress")
 	}
 
 	return err
@@ -141,28 +365,123 @@ func (i *Ingress) UpdateIngress(ingresses []*networkingv1beta1.Ingress, osn, nsn
 
 func (i *Ingress) DeleteIngress() (err error) {
 	deletePolicy := metav1.DeletePropagationForeground
-	ingName := getIngressName(i.ServiceName)
+	ingName := i.Config.IngressName(i.ServiceName)
 	log.Info().Str("ingName", ingName)
 	ns := i.Namespace
-	err = i.K8sClient.NetworkingV1beta1().Ingresses(ns).Delete(ingName, &metav1.DeleteOptions{
+	err = i.client().Delete(ns, ingName, metav1.DeleteOptions{
 		PropagationPolicy: &deletePolicy,
 	})
+	// The service is gone, the events go to the deployment of its name
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: i.ServiceName, Namespace: ns}}
+	if k8serrors.IsNotFound(err) {
+		return
+	}
 	if err != nil {
 		log.Error().
 			Err(err).
 			Str("namespace", ns).
 			Str("ingress name", ingName).
 			Send()
+		i.event(svc, corev1.EventTypeWarning, "FailedDeleteIngress", "Ingress %s of the deleted service %s was not deleted: %v", ingName, i.ServiceName, err)
+		return
 	}
+	i.event(svc, corev1.EventTypeNormal, "DeletedIngress", "Ingress %s was deleted along with the service %s", ingName, i.ServiceName)
 
-	return
+	return i.patchStatus(svc, ingName, "")
+}
+
+// checkHostConflict returns a HostConflictError when another ingress of the
+// cluster already routes the host h, and records it on the workload of svc.
+func (i *Ingress) checkHostConflict(svc *corev1.Service, h string) error {
+	if i.Lister == nil {
+		return nil
+	}
+
+	ingresses, err := i.Lister.List("")
+	if err != nil {
+		return err
+	}
+	ingName := i.Config.IngressName(svc.Name)
+	for _, ing := range ingresses {
+		if ing.Namespace == svc.Namespace && ing.Name == ingName {
+			continue
+		}
+		for _, ir := range ing.Spec.Rules {
+			if ir.Host != h || ir.HTTP == nil {
+				continue
+			}
+			for _, p := range ir.HTTP.Paths {
+				if p.Path != "/" && p.Path != "" {
+					continue
+				}
+
+				err := &HostConflictError{Host: h, Path: "/", Namespace: ing.Namespace, Name: ing.Name}
+				log.Error().
+					Err(err).
+					Str("namespace", svc.Namespace).
+					Str("ingress name", ingName).
+					Msg("refuse to route the host")
+				i.event(svc, corev1.EventTypeWarning, "HostConflict", "Ingress %s was not routed: %v", ingName, err)
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// event records an event on the workload of the service svc when the ingress
+// has a recorder.
+func (i *Ingress) event(svc *corev1.Service, eventType, reason, messageFmt string, args ...interface{}) {
+	if i.Recorder != nil {
+		i.Recorder.Eventf(service.WorkloadReference(i.Config, svc), eventType, reason, messageFmt, args...)
+	}
+}
+
+// patchStatus records the ingress ingName of the service svc and the URL it
+// routes in the annotations of the workload of svc, or removes them when url
+// is empty.
+func (i *Ingress) patchStatus(svc *corev1.Service, ingName, url string) error {
+	if i.Workloads == nil {
+		return nil
+	}
+	ref := service.WorkloadReference(i.Config, svc)
+	annotations, err := i.Workloads.Annotations(ref)
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if url == "" {
+		// The ingress of a renamed service may already be recorded in place of
+		// the deleted one
+		if annotations[service.ManagedIngressAnnotation] != ingName {
+			return nil
+		}
+		ingName = ""
+	}
+
+	return service.PatchStatus(i.K8sClient, ref, annotations, map[string]string{service.ManagedIngressAnnotation: ingName, service.URLAnnotation: url})
+}
+
+func (i *Ingress) client() *Client {
+	return &Client{K8sClient: i.K8sClient, Version: i.Version}
+}
+
+// NewOwnerReference returns the controller reference of the ingress of svc.
+func NewOwnerReference(svc *corev1.Service) *metav1.OwnerReference {
+	return metav1.NewControllerRef(svc, corev1.SchemeGroupVersion.WithKind("Service"))
 }
 
-func HasIngressExists(sn string, ingresses []*networkingv1beta1.Ingress) bool {
+func HasIngressExists(sn string, ingresses []*networkingv1.Ingress) bool {
 	for _, ing := range ingresses {
 		for _, ir := range ing.Spec.Rules {
+			if ir.HTTP == nil {
+				continue
+			}
 			for _, p := range ir.HTTP.Paths {
-				if sn == p.Backend.ServiceName {
+				if sn == getBackendServiceName(p) {
 					return true
 				}
 			}
@@ -172,51 +491,231 @@ func HasIngressExists(sn string, ingresses []*networkingv1beta1.Ingress) bool {
 	return false
 }
 
-func getIngresses(sn, ns string, informer informers.SharedInformerFactory) (ret []*networkingv1beta1.Ingress, err error) {
-	ingLister := informer.Networking().V1beta1().Ingresses()
-	ret, err = ingLister.Lister().Ingresses(sn).List(labels.Everything())
-	if err != nil {
-		log.Error().Err(err).Msgf("onAddFunc - Error to list ingresses by labels %v from namespace %s", labels.Everything(), ns)
+// getIngress returns the ingress routed to the service sn, or nil.
+func getIngress(sn string, ingresses []*networkingv1.Ingress) *networkingv1.Ingress {
+	for _, ing := range ingresses {
+		if len(ing.Spec.Rules) == 0 || ing.Spec.Rules[0].HTTP == nil || len(ing.Spec.Rules[0].HTTP.Paths) == 0 {
+			continue
+		}
+		if getBackendServiceName(ing.Spec.Rules[0].HTTP.Paths[0]) == sn {
+			return ing
+		}
 	}
 
-	return
+	return nil
+}
+
+// getIngressByName returns the ingress named name, or nil.
+func getIngressByName(name string, ingresses []*networkingv1.Ingress) *networkingv1.Ingress {
+	for _, ing := range ingresses {
+		if ing.Name == name {
+			return ing
+		}
+	}
+
+	return nil
+}
+
+// ingressURL returns the URL routed by the ingress ing, at the host h unless h
+// is empty. It is empty when ing is nil.
+func ingressURL(ing *networkingv1.Ingress, h string) string {
+	if ing == nil || len(ing.Spec.Rules) == 0 {
+		return ""
+	}
+	if h == "" {
+		h = ing.Spec.Rules[0].Host
+	}
+	if len(ing.Spec.TLS) > 0 {
+		return "https://" + h
+	}
+
+	return "http://" + h
+}
+
+// getDesiredHost returns the host the ingress of svc should be moved to, or
+// an empty string when the current host has to be kept. Hosts generated by
+// the random strategy are only replaced by an explicit hostname annotation.
+func getDesiredHost(conf *config.Config, svc *corev1.Service, ingresses []*networkingv1.Ingress) (string, error) {
+	for _, ing := range ingresses {
+		if len(ing.Spec.Rules) == 0 || ing.Spec.Rules[0].HTTP == nil || len(ing.Spec.Rules[0].HTTP.Paths) == 0 ||
+			getBackendServiceName(ing.Spec.Rules[0].HTTP.Paths[0]) != svc.Name {
+			continue
+		}
+		if svc.Annotations["pigo.network/hostname"] == "" && ing.Annotations["pigo.io/hostname-strategy"] != hostname.StrategyTemplate {
+			return "", nil
+		}
+
+		h, err := newHostname(conf, svc)
+		if err != nil || h == ing.Spec.Rules[0].Host {
+			return "", err
+		}
+		return h, nil
+	}
+
+	return "", nil
+}
+
+// newHostname returns the hostname of the ingress of svc.
+func newHostname(conf *config.Config, svc *corev1.Service) (string, error) {
+	return hostname.New(conf, svc.Annotations["pigo.network/hostname"], conf.WorkloadName(svc.Name), svc.Namespace)
+}
+
+// getTLS returns the TLS of the ingress of svc routed to the host h, it is
+// empty when TLS is not configured or the service opted out of it.
+func getTLS(conf *config.Config, svc *corev1.Service, h string) []networkingv1.IngressTLS {
+	if svc.Annotations["pigo.network/tls"] == "false" {
+		return nil
+	}
+	// cert-manager issues a certificate per ingress into the secret
+	if conf.TLSClusterIssuer != "" {
+		return []networkingv1.IngressTLS{{Hosts: []string{h}, SecretName: conf.IngressName(svc.Name) + "-tls"}}
+	}
+	if conf.TLSSecret != "" {
+		return []networkingv1.IngressTLS{{Hosts: []string{h}, SecretName: conf.TLSSecret}}
+	}
+
+	return nil
+}
+
+// getIngressClass returns the ingress class of the ingress of svc, an empty
+// string leaves it to the default ingress class of the cluster.
+func getIngressClass(conf *config.Config, svc *corev1.Service) string {
+	if c := svc.Annotations["pigo.network/ingress-class"]; c != "" {
+		return c
+	}
+
+	return conf.IngressClass
+}
+
+func getIngressClassName(sn string, ingresses []*networkingv1.Ingress) string {
+	for _, ing := range ingresses {
+		if len(ing.Spec.Rules) == 0 || ing.Spec.Rules[0].HTTP == nil || len(ing.Spec.Rules[0].HTTP.Paths) == 0 ||
+			getBackendServiceName(ing.Spec.Rules[0].HTTP.Paths[0]) != sn {
+			continue
+		}
+		if ing.Spec.IngressClassName != nil {
+			return *ing.Spec.IngressClassName
+		}
+		return ""
+	}
+
+	return ""
+}
+
+func getIngressServicePort(sn string, ingresses []*networkingv1.Ingress) networkingv1.ServiceBackendPort {
+	for _, ing := range ingresses {
+		for _, ir := range ing.Spec.Rules {
+			if ir.HTTP == nil {
+				continue
+			}
+			for _, p := range ir.HTTP.Paths {
+				if sn == getBackendServiceName(p) {
+					return p.Backend.Service.Port
+				}
+			}
+		}
+	}
+
+	return networkingv1.ServiceBackendPort{}
 }
 
-func newIngress(hostname, sn, ns string, sp []corev1.ServicePort) (ing *networkingv1beta1.Ingress) {
-	annotations := map[string]string{"nginx.ingress.kubernetes.io/rewrite-target": "/"}
+// getBackendServiceName returns the name of the service backing the path, or
+// an empty string for a resource backend.
+func getBackendServiceName(p networkingv1.HTTPIngressPath) string {
+	if p.Backend.Service == nil {
+		return ""
+	}
 
-	ing = &networkingv1beta1.Ingress{
+	return p.Backend.Service.Name
+}
+
+func newIngress(conf *config.Config, host string, svc *corev1.Service) (ing *networkingv1.Ingress) {
+	annotations := map[string]string{
+		"nginx.ingress.kubernetes.io/rewrite-target": "/",
+		"pigo.io/part-of": conf.PartOf,
+	}
+	if svc.Annotations["pigo.network/hostname"] != "" || hostname.Strategy(conf) == hostname.StrategyTemplate {
+		annotations["pigo.io/hostname-strategy"] = hostname.StrategyTemplate
+	}
+
+	ing = &networkingv1.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:        getIngressName(sn),
-			Namespace:   ns,
+			Name:        conf.IngressName(svc.Name),
+			Namespace:   svc.Namespace,
 			Annotations: annotations,
+			// The ingress is garbage collected along with its service
+			OwnerReferences: []metav1.OwnerReference{*NewOwnerReference(svc)},
 		},
-		Spec: networkingv1beta1.IngressSpec{
-			Rules: getRules(sn, hostname, sp),
+		Spec: networkingv1.IngressSpec{
+			Rules: getRules(conf, svc, host),
 		},
 	}
+	if c := getIngressClass(conf, svc); c != "" {
+		ing.Spec.IngressClassName = &c
+	}
+	setTLS(conf, svc, ing, host)
 
 	return
 }
 
-func getIngressName(sn string) string {
-	return os.Getenv("BOT_INGRESS_PREFIX") + strings.TrimPrefix(sn, os.Getenv("BOT_SERVICE_PREFIX"))
+// tlsAnnotations are the annotations of the ingresses set along with their
+// TLS.
+var tlsAnnotations = []string{"cert-manager.io/cluster-issuer", "nginx.ingress.kubernetes.io/force-ssl-redirect"}
+
+// setTLS sets the TLS of the ingress ing of svc routed to the host h, and
+// the annotations of the certificate and of the HTTPS redirection.
+func setTLS(conf *config.Config, svc *corev1.Service, ing *networkingv1.Ingress, h string) {
+	if ing.Annotations == nil {
+		ing.Annotations = map[string]string{}
+	}
+	for _, k := range tlsAnnotations {
+		delete(ing.Annotations, k)
+	}
+	ing.Spec.TLS = getTLS(conf, svc, h)
+	if len(ing.Spec.TLS) == 0 {
+		return
+	}
+	if conf.TLSClusterIssuer != "" {
+		ing.Annotations["cert-manager.io/cluster-issuer"] = conf.TLSClusterIssuer
+	}
+	if conf.TLSForceSSLRedirect {
+		ing.Annotations["nginx.ingress.kubernetes.io/force-ssl-redirect"] = "true"
+	}
 }
 
-func getPaths(sn string, ports []corev1.ServicePort) (paths []networkingv1beta1.HTTPIngressPath) {
-	var port int32
-	for _, sp := range ports {
-		if strings.HasPrefix(sp.Name, os.Getenv("BOT_SERVICE_PREFIX") + "port-") {
-			port = sp.Port
-			break
+// tlsDrifted returns true if the TLS of the ingress ing of svc differs from
+// the one it should have once moved to the host h, unless h is empty.
+func tlsDrifted(conf *config.Config, svc *corev1.Service, ing *networkingv1.Ingress, h string) bool {
+	if ing == nil || len(ing.Spec.Rules) == 0 {
+		return false
+	}
+	if h == "" {
+		h = ing.Spec.Rules[0].Host
+	}
+	desired := ing.DeepCopy()
+	setTLS(conf, svc, desired, h)
+	if (len(desired.Spec.TLS) > 0 || len(ing.Spec.TLS) > 0) && !reflect.DeepEqual(desired.Spec.TLS, ing.Spec.TLS) {
+		return true
+	}
+	for _, k := range tlsAnnotations {
+		if desired.Annotations[k] != ing.Annotations[k] {
+			return true
 		}
 	}
 
-	path := networkingv1beta1.HTTPIngressPath{
+	return false
+}
+
+func getPaths(conf *config.Config, svc *corev1.Service) (paths []networkingv1.HTTPIngressPath) {
+	pathType := networkingv1.PathTypePrefix
+	path := networkingv1.HTTPIngressPath{
 		Path: "/",
-		Backend: networkingv1beta1.IngressBackend{
-			ServiceName: sn,
-			ServicePort: intstr.IntOrString{Type: intstr.Int, IntVal: port},
+		PathType: &pathType,
+		Backend: networkingv1.IngressBackend{
+			Service: &networkingv1.IngressServiceBackend{
+				Name: svc.Name,
+				Port: networkingv1.ServiceBackendPort{Name: service.GetIngressPortName(conf, svc)},
+			},
 		},
 	}
 	paths = append(paths, path)
@@ -224,12 +723,12 @@ func getPaths(sn string, ports []corev1.ServicePort) (paths []networkingv1beta1.
 	return
 }
 
-func getRules(sn, h string, ports []corev1.ServicePort) (rules []networkingv1beta1.IngressRule) {
-	irv := networkingv1beta1.HTTPIngressRuleValue{Paths: getPaths(sn, ports)}
+func getRules(conf *config.Config, svc *corev1.Service, h string) (rules []networkingv1.IngressRule) {
+	irv := networkingv1.HTTPIngressRuleValue{Paths: getPaths(conf, svc)}
 
-	rule := networkingv1beta1.IngressRule{
+	rule := networkingv1.IngressRule{
 		Host: h,
-		IngressRuleValue: networkingv1beta1.IngressRuleValue{HTTP: &irv},
+		IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &irv},
 	}
 	rules = append(rules, rule)
 
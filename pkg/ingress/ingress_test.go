@@ -1,26 +1,33 @@
 package ingress
 
 import (
+	"context"
+	"github.com/pinative/k8s-bot/pkg/config"
+	"github.com/pinative/k8s-bot/pkg/service"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/api/networking/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
-	"log"
-	"os"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"strings"
 	"testing"
+	"time"
 )
 
-func init() {
-	log.Println("Setting environment variable for Ingress testing")
-	_ = os.Setenv("BOT_SERVICE_PREFIX", "svc-")
-	_ = os.Setenv("BOT_INGRESS_PREFIX", "ing-")
-}
+var testConfig = &config.Config{PartOf: "k8s.bot", ServicePrefix: "svc-", IngressPrefix: "ing-", Domain: ".apps.example.com", HostnameStrategy: "template"}
 
 func newService() *corev1.Service {
 	return &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: os.Getenv("BOT_SERVICE_PREFIX") + "fake-test",
+			Name: testConfig.ServicePrefix + "fake-test",
 			Namespace: "fake-test",
 		},
 	}
@@ -29,7 +36,7 @@ func newService() *corev1.Service {
 func newFakeNetworkingIngress() *v1beta1.Ingress {
 	return &v1beta1.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: os.Getenv("BOT_INGRESS_PREFIX") + "fake-test",
+			Name: testConfig.IngressPrefix + "fake-test",
 			Namespace: "fake-test",
 		},
 		Spec: v1beta1.IngressSpec{
@@ -41,7 +48,7 @@ func newFakeNetworkingIngress() *v1beta1.Ingress {
 							Paths: []v1beta1.HTTPIngressPath{
 								{
 									Backend: v1beta1.IngressBackend{
-										ServiceName: os.Getenv("BOT_SERVICE_PREFIX") + "fake-test",
+										ServiceName: testConfig.ServicePrefix + "fake-test",
 										ServicePort: intstr.IntOrString{Type: intstr.Int, IntVal: 80 },
 									},
 								},
@@ -57,52 +64,64 @@ func newFakeNetworkingIngress() *v1beta1.Ingress {
 func newFakeIngress() *Ingress {
 	return &Ingress{
 		K8sClient: fake.NewSimpleClientset(newService(), newFakeNetworkingIngress()),
+		Version: NetworkingV1beta1,
+		Config: testConfig,
 	}
 }
 
 func TestIngress_CreateIngress(t *testing.T) {
 	ing := newFakeIngress()
-	sn := os.Getenv("BOT_SERVICE_PREFIX") + "fake-create-new"
+	sn := testConfig.ServicePrefix + "fake-create-new"
 	ns := "fake-test"
-	err := ing.CreateIngress(sn, ns, []corev1.ServicePort{{Name: os.Getenv("BOT_SERVICE_PREFIX") + "port-fake-create-new", Port: int32(80), TargetPort: intstr.IntOrString{Type: intstr.Int, IntVal: int32(8080)}}})
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: sn, Namespace: ns, UID: "fake-uid"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: testConfig.ServicePrefix + "port-fake-create-new", Port: int32(80), TargetPort: intstr.IntOrString{Type: intstr.Int, IntVal: int32(8080)}}},
+		},
+	}
+	err := ing.CreateIngress(svc)
 	if err != nil {
 		t.Errorf("Expected without any error to create a new ingress, but got error: %v", err)
 		return
 	}
 
-	ingress, err := ing.K8sClient.NetworkingV1beta1().Ingresses(ns).Get(getIngressName(sn), metav1.GetOptions{})
+	ingress, err := ing.K8sClient.NetworkingV1beta1().Ingresses(ns).Get(context.TODO(), testConfig.IngressName(sn), metav1.GetOptions{})
 	if err != nil {
 		t.Errorf("Expected get the ingress just created, but got error: %v", err)
 		return
 	}
 
-	if ingress.Name != getIngressName(sn) {
-		t.Errorf("Expected the created ingress name to be %s, but got %s", getIngressName(sn), ingress.Name)
+	if ingress.Name != testConfig.IngressName(sn) {
+		t.Errorf("Expected the created ingress name to be %s, but got %s", testConfig.IngressName(sn), ingress.Name)
+	}
+
+	if ref := metav1.GetControllerOf(ingress); ref == nil || ref.UID != svc.UID {
+		t.Errorf("Expected the created ingress to be owned by the service %s, but got %v", sn, ref)
 	}
 }
 
 func TestIngress_UpdateIngress(t *testing.T) {
 	ing := newFakeIngress()
-	ing.ServiceName = os.Getenv("BOT_SERVICE_PREFIX") + "fake-test"
+	ing.ServiceName = testConfig.ServicePrefix + "fake-test"
 	ing.Namespace = "fake-test"
 
-	ingresses := []*v1beta1.Ingress{newFakeNetworkingIngress()}
+	ingresses := []*networkingv1.Ingress{toV1(newFakeNetworkingIngress())}
 
-	nsn := os.Getenv("BOT_SERVICE_PREFIX") + "fake-new-test"
-	nsp := int32(8080)
-	err := ing.UpdateIngress(ingresses, ing.ServiceName, nsn, ing.Namespace, nsp)
+	nsn := testConfig.ServicePrefix + "fake-new-test"
+	nsp := "http"
+	err := ing.UpdateIngress(ingresses, ing.ServiceName, nsn, ing.Namespace, "", "", nsp)
 	if err != nil {
 		t.Errorf("Expected no error thrown when updating ingress by service name %s, but got error: %v", ing.ServiceName, err)
 		return
 	}
 
-	i, _ := ing.K8sClient.NetworkingV1beta1().Ingresses(ing.Namespace).Get(getIngressName(ing.ServiceName), metav1.GetOptions{})
+	i, _ := ing.K8sClient.NetworkingV1beta1().Ingresses(ing.Namespace).Get(context.TODO(), testConfig.IngressName(ing.ServiceName), metav1.GetOptions{})
 	if len(i.Spec.Rules) > 1 {
-		t.Errorf("Expected only have one rule for the ingress %s, but got %v", getIngressName(ing.ServiceName), len(i.Spec.Rules))
+		t.Errorf("Expected only have one rule for the ingress %s, but got %v", testConfig.IngressName(ing.ServiceName), len(i.Spec.Rules))
 	}
 
 	if len(i.Spec.Rules[0].HTTP.Paths) > 1 {
-		t.Errorf("Expected only have one path for the ingress %s, but got %v", getIngressName(ing.ServiceName), len(i.Spec.Rules[0].HTTP.Paths))
+		t.Errorf("Expected only have one path for the ingress %s, but got %v", testConfig.IngressName(ing.ServiceName), len(i.Spec.Rules[0].HTTP.Paths))
 	}
 
 	un := i.Spec.Rules[0].HTTP.Paths[0].Backend.ServiceName
@@ -111,14 +130,14 @@ func TestIngress_UpdateIngress(t *testing.T) {
 	}
 
 	up := i.Spec.Rules[0].HTTP.Paths[0].Backend.ServicePort
-	if up.IntVal == 80 || up.IntVal != nsp {
-		t.Errorf("Expected the service port should be updated to %v, but got %v", nsp, up.IntVal)
+	if up.IntVal == 80 || up.StrVal != nsp {
+		t.Errorf("Expected the service port should be updated to %v, but got %v", nsp, up.String())
 	}
 }
 
 func TestIngress_DeleteIngressWithPass(t *testing.T) {
 	ing := newFakeIngress()
-	ing.ServiceName = os.Getenv("BOT_SERVICE_PREFIX") + "fake-test"
+	ing.ServiceName = testConfig.ServicePrefix + "fake-test"
 	ing.Namespace = "fake-test"
 
 	err := ing.DeleteIngress()
@@ -129,7 +148,7 @@ func TestIngress_DeleteIngressWithPass(t *testing.T) {
 
 func TestIngress_DeleteIngressWithError(t *testing.T) {
 	ing := newFakeIngress()
-	ing.ServiceName = os.Getenv("BOT_SERVICE_PREFIX") + "test"
+	ing.ServiceName = testConfig.ServicePrefix + "test"
 	ing.Namespace = "fake-test"
 
 	err := ing.DeleteIngress()
@@ -139,11 +158,11 @@ func TestIngress_DeleteIngressWithError(t *testing.T) {
 }
 
 func TestHasIngressExists(t *testing.T) {
-	ingresses := []*v1beta1.Ingress{
-		getFakeIngress(),
+	ingresses := []*networkingv1.Ingress{
+		toV1(getFakeIngress()),
 	}
 
-	isExisted := HasIngressExists(os.Getenv("BOT_SERVICE_PREFIX") + "fake-test", ingresses)
+	isExisted := HasIngressExists(testConfig.ServicePrefix + "fake-test", ingresses)
 	if !isExisted {
 		t.Errorf("Expected the ingress exist status to be true but got %v", isExisted)
 	}
@@ -159,7 +178,7 @@ func getFakeIngress() (ing *v1beta1.Ingress) {
 		Paths: []v1beta1.HTTPIngressPath{
 			{
 				Backend: v1beta1.IngressBackend{
-					ServiceName: os.Getenv("BOT_SERVICE_PREFIX") + "fake-test",
+					ServiceName: testConfig.ServicePrefix + "fake-test",
 					ServicePort: intstr.IntOrString{Type: intstr.Int, IntVal: 80},
 				},
 			},
@@ -170,7 +189,7 @@ func getFakeIngress() (ing *v1beta1.Ingress) {
 	}
 	ing = &v1beta1.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: os.Getenv("BOT_INGRESS_PREFIX") + "fake-test",
+			Name: testConfig.IngressPrefix + "fake-test",
 			Namespace: "fake-test",
 		},
 		Spec: v1beta1.IngressSpec{
@@ -183,4 +202,668 @@ func getFakeIngress() (ing *v1beta1.Ingress) {
 		},
 	}
 	return
-}
\ No newline at end of file
+}
+func TestIngress_CreateIngressWithHostConflict(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ing := newFakeIngress()
+	infmrs := informers.NewSharedInformerFactory(ing.K8sClient, 0)
+	ingInformer := Informer(infmrs, ing.Version)
+	infmrs.Start(ctx.Done())
+	cache.WaitForCacheSync(ctx.Done(), ingInformer.HasSynced)
+
+	recorder := record.NewFakeRecorder(1)
+	ing.Lister = NewLister(infmrs, ing.Version)
+	ing.Recorder = recorder
+
+	// The host is already routed to the fake-test service of the fake-test namespace
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: testConfig.ServicePrefix + "fake-test",
+			Namespace: "other-test",
+			Annotations: map[string]string{"pigo.network/hostname": "fake-test.apps.pidns.host"},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: testConfig.ServicePrefix + "port-fake-test", Port: int32(80)}},
+		},
+	}
+	err := ing.CreateIngress(svc)
+	if _, ok := err.(*HostConflictError); !ok {
+		t.Errorf("Expected a host conflict error to be returned, but got %v", err)
+	}
+
+	_, err = ing.K8sClient.NetworkingV1beta1().Ingresses(svc.Namespace).Get(context.TODO(), testConfig.IngressName(svc.Name), metav1.GetOptions{})
+	if err == nil {
+		t.Errorf("Expected the conflicting ingress not to be created")
+	}
+
+	select {
+	case e := <-recorder.Events:
+		if !strings.HasPrefix(e, corev1.EventTypeWarning + " HostConflict") {
+			t.Errorf("Expected a HostConflict warning event, but got %s", e)
+		}
+	default:
+		t.Errorf("Expected a HostConflict warning event to be recorded, but got none")
+	}
+}
+
+func TestIngress_CreateIngressWithNetworkingV1(t *testing.T) {
+	ing := &Ingress{K8sClient: fake.NewSimpleClientset(), Version: NetworkingV1, Config: testConfig}
+	sn := testConfig.ServicePrefix + "fake-create-v1"
+	ns := "fake-test"
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: sn, Namespace: ns, UID: "fake-uid"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: testConfig.ServicePrefix + "port-fake-create-v1", Port: int32(80), TargetPort: intstr.IntOrString{Type: intstr.Int, IntVal: int32(8080)}}},
+		},
+	}
+	err := ing.CreateIngress(svc)
+	if err != nil {
+		t.Errorf("Expected without any error to create a new ingress, but got error: %v", err)
+		return
+	}
+
+	ingress, err := ing.K8sClient.NetworkingV1().Ingresses(ns).Get(context.TODO(), testConfig.IngressName(sn), metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("Expected get the ingress just created, but got error: %v", err)
+		return
+	}
+
+	p := ingress.Spec.Rules[0].HTTP.Paths[0]
+	if p.PathType == nil || *p.PathType != networkingv1.PathTypePrefix {
+		t.Errorf("Expected the path type to be %s, but got %v", networkingv1.PathTypePrefix, p.PathType)
+	}
+
+	if p.Backend.Service == nil || p.Backend.Service.Name != sn || p.Backend.Service.Port.Name != testConfig.ServicePrefix + "port-fake-create-v1" {
+		t.Errorf("Expected the backend to be the service %s on port svc-port-fake-create-v1, but got %v", sn, p.Backend.Service)
+	}
+}
+
+func TestDetectAPIVersion(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	v, err := DetectAPIVersion(client)
+	if err != nil {
+		t.Errorf("Expected no errors occured to detect the ingress API version, but got error: %v", err)
+	}
+	if v != NetworkingV1beta1 {
+		t.Errorf("Expected the API version to be %s, but got %s", NetworkingV1beta1, v)
+	}
+
+	client.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: string(NetworkingV1),
+			APIResources: []metav1.APIResource{{Name: "ingresses", Kind: "Ingress"}},
+		},
+	}
+	v, err = DetectAPIVersion(client)
+	if err != nil {
+		t.Errorf("Expected no errors occured to detect the ingress API version, but got error: %v", err)
+	}
+	if v != NetworkingV1 {
+		t.Errorf("Expected the API version to be %s, but got %s", NetworkingV1, v)
+	}
+}
+
+func TestIngress_CreateIngressWithIngressClass(t *testing.T) {
+	conf := *testConfig
+	conf.IngressClass = "nginx-internal"
+
+	ns := "fake-test"
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: testConfig.ServicePrefix + "fake-class", Namespace: ns},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: testConfig.ServicePrefix + "port-fake-class", Port: int32(80)}},
+		},
+	}
+	ing := &Ingress{K8sClient: fake.NewSimpleClientset(), Version: NetworkingV1, Config: &conf}
+	if err := ing.CreateIngress(svc); err != nil {
+		t.Errorf("Expected without any error to create a new ingress, but got error: %v", err)
+		return
+	}
+
+	i, err := ing.K8sClient.NetworkingV1().Ingresses(ns).Get(context.TODO(), conf.IngressName(svc.Name), metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("Expected get the ingress just created, but got error: %v", err)
+		return
+	}
+	if i.Spec.IngressClassName == nil || *i.Spec.IngressClassName != "nginx-internal" {
+		t.Errorf("Expected the ingress class name to be nginx-internal, but got %v", i.Spec.IngressClassName)
+	}
+
+	// The annotation of the deployment overrides the ingress class of the configuration
+	svc.Annotations = map[string]string{"pigo.network/ingress-class": "nginx-external"}
+	ing = &Ingress{K8sClient: fake.NewSimpleClientset(), Version: NetworkingV1beta1, Config: &conf}
+	if err := ing.CreateIngress(svc); err != nil {
+		t.Errorf("Expected without any error to create a new ingress, but got error: %v", err)
+		return
+	}
+
+	legacy, err := ing.K8sClient.NetworkingV1beta1().Ingresses(ns).Get(context.TODO(), conf.IngressName(svc.Name), metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("Expected get the ingress just created, but got error: %v", err)
+		return
+	}
+	if c := legacy.Annotations["kubernetes.io/ingress.class"]; c != "nginx-external" {
+		t.Errorf("Expected the legacy ingress class annotation to be nginx-external, but got %s", c)
+	}
+	if legacy.Spec.IngressClassName != nil {
+		t.Errorf("Expected no ingress class name on networking.k8s.io/v1beta1, but got %s", *legacy.Spec.IngressClassName)
+	}
+
+	if c := getIngressClassName(svc.Name, []*networkingv1.Ingress{toV1(legacy)}); c != "nginx-external" {
+		t.Errorf("Expected the ingress class read back to be nginx-external, but got %s", c)
+	}
+}
+
+func TestIngress_CreateIngressWithTLS(t *testing.T) {
+	conf := *testConfig
+	conf.TLSClusterIssuer = "letsencrypt"
+	conf.TLSForceSSLRedirect = true
+
+	ns := "fake-test"
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: testConfig.ServicePrefix + "fake-tls",
+			Namespace: ns,
+			Annotations: map[string]string{"pigo.network/hostname": "fake-tls.apps.pidns.host"},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: testConfig.ServicePrefix + "port-fake-tls", Port: int32(80)}},
+		},
+	}
+	ing := &Ingress{K8sClient: fake.NewSimpleClientset(), Version: NetworkingV1, Config: &conf}
+	if err := ing.CreateIngress(svc); err != nil {
+		t.Errorf("Expected without any error to create a new ingress, but got error: %v", err)
+		return
+	}
+
+	i, err := ing.K8sClient.NetworkingV1().Ingresses(ns).Get(context.TODO(), conf.IngressName(svc.Name), metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("Expected get the ingress just created, but got error: %v", err)
+		return
+	}
+	if len(i.Spec.TLS) != 1 || i.Spec.TLS[0].SecretName != conf.IngressName(svc.Name) + "-tls" || i.Spec.TLS[0].Hosts[0] != "fake-tls.apps.pidns.host" {
+		t.Errorf("Expected the ingress TLS to use a generated secret for the host fake-tls.apps.pidns.host, but got %v", i.Spec.TLS)
+	}
+	if ci := i.Annotations["cert-manager.io/cluster-issuer"]; ci != "letsencrypt" {
+		t.Errorf("Expected the cluster issuer annotation to be letsencrypt, but got %s", ci)
+	}
+	if r := i.Annotations["nginx.ingress.kubernetes.io/force-ssl-redirect"]; r != "true" {
+		t.Errorf("Expected the HTTPS redirect to be forced, but got %s", r)
+	}
+
+	// The new host is moved into the certificate as well
+	err = ing.UpdateIngress([]*networkingv1.Ingress{i}, svc.Name, svc.Name, ns, "moved.apps.pidns.host", "", "")
+	if err != nil {
+		t.Errorf("Expected no error thrown when updating ingress by service name %s, but got error: %v", svc.Name, err)
+		return
+	}
+	i, _ = ing.K8sClient.NetworkingV1().Ingresses(ns).Get(context.TODO(), conf.IngressName(svc.Name), metav1.GetOptions{})
+	if i.Spec.TLS[0].Hosts[0] != "moved.apps.pidns.host" {
+		t.Errorf("Expected the TLS host to be moved to moved.apps.pidns.host, but got %v", i.Spec.TLS[0].Hosts)
+	}
+}
+
+func TestIngress_UpsertIngressWithTLS(t *testing.T) {
+	conf := *testConfig
+	conf.TLSSecret = "wildcard-tls"
+	conf.TLSForceSSLRedirect = true
+
+	ns := "fake-test"
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: testConfig.ServicePrefix + "fake-tls",
+			Namespace: ns,
+			Annotations: map[string]string{"pigo.io/part-of": testConfig.PartOf, "pigo.network/allow-internet-access": "true", "pigo.network/port": "http"},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "http", Port: int32(80)}},
+		},
+	}
+	client := fake.NewSimpleClientset()
+	ing := &Ingress{K8sClient: client, Version: NetworkingV1, Config: &conf}
+	if err := ing.CreateIngress(svc); err != nil {
+		t.Errorf("Expected without any error to create a new ingress, but got error: %v", err)
+		return
+	}
+	upsert := func() *networkingv1.Ingress {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		infmrs := informers.NewSharedInformerFactory(client, 0)
+		ingInformer := Informer(infmrs, ing.Version)
+		infmrs.Start(ctx.Done())
+		cache.WaitForCacheSync(ctx.Done(), ingInformer.HasSynced)
+		ing.Lister = NewLister(infmrs, ing.Version)
+		if err := ing.UpsertIngress(svc); err != nil {
+			t.Errorf("Expected without any error to update the ingress, but got error: %v", err)
+		}
+		i, _ := client.NetworkingV1().Ingresses(ns).Get(context.TODO(), conf.IngressName(svc.Name), metav1.GetOptions{})
+		return i
+	}
+
+	// The service opted out of TLS
+	svc.Annotations["pigo.network/tls"] = "false"
+	i := upsert()
+	if len(i.Spec.TLS) != 0 {
+		t.Errorf("Expected the TLS to be removed from the ingress, but got %v", i.Spec.TLS)
+	}
+	if r, ok := i.Annotations["nginx.ingress.kubernetes.io/force-ssl-redirect"]; ok {
+		t.Errorf("Expected the HTTPS redirect to be removed, but got %s", r)
+	}
+
+	// The service opted in again with a cluster issuer enabled
+	delete(svc.Annotations, "pigo.network/tls")
+	conf.TLSClusterIssuer = "letsencrypt"
+	i = upsert()
+	if len(i.Spec.TLS) != 1 || i.Spec.TLS[0].SecretName != conf.IngressName(svc.Name) + "-tls" || i.Spec.TLS[0].Hosts[0] != i.Spec.Rules[0].Host {
+		t.Errorf("Expected the ingress TLS to use a generated secret for the host %s, but got %v", i.Spec.Rules[0].Host, i.Spec.TLS)
+	}
+	if ci := i.Annotations["cert-manager.io/cluster-issuer"]; ci != "letsencrypt" {
+		t.Errorf("Expected the cluster issuer annotation to be letsencrypt, but got %s", ci)
+	}
+	if r := i.Annotations["nginx.ingress.kubernetes.io/force-ssl-redirect"]; r != "true" {
+		t.Errorf("Expected the HTTPS redirect to be forced, but got %s", r)
+	}
+}
+
+func TestIngress_UpsertIngressWithRenamedPrefix(t *testing.T) {
+	old := *testConfig
+	conf := *testConfig
+	conf.IngressPrefix = "web-"
+
+	ns := "fake-test"
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: testConfig.ServicePrefix + "fake-rename",
+			Namespace: ns,
+			UID: "fake-rename-uid",
+			Annotations: map[string]string{"pigo.io/part-of": testConfig.PartOf, "pigo.network/allow-internet-access": "true", "pigo.network/port": "http"},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "http", Port: int32(80)}},
+		},
+	}
+	client := fake.NewSimpleClientset()
+	ing := &Ingress{K8sClient: client, Version: NetworkingV1, Config: &old}
+	if err := ing.CreateIngress(svc); err != nil {
+		t.Errorf("Expected without any error to create a new ingress, but got error: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	infmrs := informers.NewSharedInformerFactory(client, 0)
+	ingInformer := Informer(infmrs, ing.Version)
+	infmrs.Start(ctx.Done())
+	cache.WaitForCacheSync(ctx.Done(), ingInformer.HasSynced)
+	ing.Lister = NewLister(infmrs, ing.Version)
+
+	// The ingress prefix has been changed
+	ing.Config = &conf
+	if err := ing.UpsertIngress(svc); err != nil {
+		t.Errorf("Expected without any error to rename the ingress, but got error: %v", err)
+		return
+	}
+	i, err := client.NetworkingV1().Ingresses(ns).Get(context.TODO(), conf.IngressName(svc.Name), metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("Expected the ingress to be created under the new name %s, but got error: %v", conf.IngressName(svc.Name), err)
+		return
+	}
+	if h := i.Spec.Rules[0].Host; h != "fake-rename.fake-test.apps.example.com" {
+		t.Errorf("Expected the renamed ingress to keep the host fake-rename.fake-test.apps.example.com, but got %s", h)
+	}
+	if _, err := client.NetworkingV1().Ingresses(ns).Get(context.TODO(), old.IngressName(svc.Name), metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected the ingress under the old name to be left to the garbage collector, but got error: %v", err)
+	}
+}
+
+func TestIngress_UpsertIngressWithRenamedServicePrefix(t *testing.T) {
+	old := *testConfig
+	conf := *testConfig
+	conf.ServicePrefix = "web-"
+
+	ns := "fake-test"
+	newSvc := func(name string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Namespace: ns,
+				UID: types.UID(name + "-uid"),
+				Annotations: map[string]string{"pigo.io/part-of": testConfig.PartOf, "pigo.network/allow-internet-access": "true", "pigo.network/port": "http"},
+			},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Name: "http", Port: int32(80)}},
+			},
+		}
+	}
+	oldSvc, svc := newSvc(old.ServiceName("fake-rename")), newSvc(conf.ServiceName("fake-rename"))
+	client := fake.NewSimpleClientset()
+	ing := &Ingress{K8sClient: client, Version: NetworkingV1, Config: &old}
+	if err := ing.CreateIngress(oldSvc); err != nil {
+		t.Errorf("Expected without any error to create a new ingress, but got error: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	infmrs := informers.NewSharedInformerFactory(client, 0)
+	ingInformer := Informer(infmrs, ing.Version)
+	infmrs.Start(ctx.Done())
+	cache.WaitForCacheSync(ctx.Done(), ingInformer.HasSynced)
+	ing.Lister = NewLister(infmrs, ing.Version)
+
+	// The service prefix has been changed, both services exist until the old
+	// one is collected
+	ing.Config = &conf
+	if err := ing.UpsertIngress(oldSvc); err != nil {
+		t.Errorf("Expected without any error to skip the service with the old prefix, but got error: %v", err)
+	}
+	if err := ing.UpsertIngress(svc); err != nil {
+		t.Errorf("Expected without any error to take the ingress over, but got error: %v", err)
+		return
+	}
+
+	il, _ := client.NetworkingV1().Ingresses(ns).List(context.TODO(), metav1.ListOptions{})
+	if len(il.Items) != 1 {
+		t.Errorf("Expected the ingress to be taken over rather than created, but got %d ingresses", len(il.Items))
+		return
+	}
+	i := il.Items[0]
+	if i.Name != conf.IngressName(svc.Name) || i.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name != svc.Name {
+		t.Errorf("Expected the ingress %s to route to the service %s, but got %s routing to %s", conf.IngressName(svc.Name), svc.Name, i.Name, i.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name)
+	}
+	if !metav1.IsControlledBy(&i, svc) {
+		t.Errorf("Expected the ingress to be owned by the service %s, but got %v", svc.Name, i.OwnerReferences)
+	}
+	if h := i.Spec.Rules[0].Host; h != "fake-rename.fake-test.apps.example.com" {
+		t.Errorf("Expected the ingress to keep the host fake-rename.fake-test.apps.example.com, but got %s", h)
+	}
+}
+
+func TestGetTLS(t *testing.T) {
+	conf := *testConfig
+	conf.TLSSecret = "wildcard-tls"
+
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: testConfig.ServicePrefix + "fake-tls"}}
+	tls := getTLS(&conf, svc, "fake-tls.apps.pidns.host")
+	if len(tls) != 1 || tls[0].SecretName != "wildcard-tls" {
+		t.Errorf("Expected the TLS to use the wildcard-tls secret, but got %v", tls)
+	}
+
+	svc.Annotations = map[string]string{"pigo.network/tls": "false"}
+	if tls := getTLS(&conf, svc, "fake-tls.apps.pidns.host"); len(tls) != 0 {
+		t.Errorf("Expected no TLS for the service opted out, but got %v", tls)
+	}
+}
+
+func TestIngress_CreateIngressWithPortAnnotation(t *testing.T) {
+	ns := "fake-test"
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: testConfig.ServicePrefix + "fake-port",
+			Namespace: ns,
+			Annotations: map[string]string{"pigo.network/port": "web"},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "admin", Port: int32(9000)}, {Name: "web", Port: int32(8080)}},
+		},
+	}
+	ing := &Ingress{K8sClient: fake.NewSimpleClientset(), Version: NetworkingV1beta1, Config: testConfig}
+	if err := ing.CreateIngress(svc); err != nil {
+		t.Errorf("Expected without any error to create a new ingress, but got error: %v", err)
+		return
+	}
+
+	i, err := ing.K8sClient.NetworkingV1beta1().Ingresses(ns).Get(context.TODO(), testConfig.IngressName(svc.Name), metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("Expected get the ingress just created, but got error: %v", err)
+		return
+	}
+	if sp := i.Spec.Rules[0].HTTP.Paths[0].Backend.ServicePort; sp.StrVal != "web" {
+		t.Errorf("Expected the backend to be routed to the port web, but got %v", sp.String())
+	}
+}
+
+func TestIngress_CreateIngressWithoutPort(t *testing.T) {
+	ns := "fake-test"
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: testConfig.ServicePrefix + "fake-no-port", Namespace: ns},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "metrics", Port: int32(9090)}},
+		},
+	}
+	recorder := record.NewFakeRecorder(1)
+	ing := &Ingress{K8sClient: fake.NewSimpleClientset(), Version: NetworkingV1, Recorder: recorder, Config: testConfig}
+	if err := ing.CreateIngress(svc); err != nil {
+		t.Errorf("Expected without any error to skip the ingress, but got error: %v", err)
+	}
+
+	_, err := ing.K8sClient.NetworkingV1().Ingresses(ns).Get(context.TODO(), testConfig.IngressName(svc.Name), metav1.GetOptions{})
+	if err == nil {
+		t.Errorf("Expected the ingress without port not to be created")
+	}
+
+	select {
+	case e := <-recorder.Events:
+		if !strings.HasPrefix(e, corev1.EventTypeWarning + " NoIngressPort") {
+			t.Errorf("Expected a NoIngressPort warning event, but got %s", e)
+		}
+	default:
+		t.Errorf("Expected a NoIngressPort warning event to be recorded, but got none")
+	}
+}
+
+func TestIngress_IngressWithEvents(t *testing.T) {
+	ns := "fake-test"
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: testConfig.ServicePrefix + "fake-events",
+			Namespace: ns,
+			Annotations: map[string]string{"pigo.network/port": "http"},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "http", Port: int32(80)}},
+		},
+	}
+	recorder := record.NewFakeRecorder(2)
+	ing := &Ingress{K8sClient: fake.NewSimpleClientset(), Version: NetworkingV1, Recorder: recorder, Config: testConfig}
+	if err := ing.CreateIngress(svc); err != nil {
+		t.Errorf("Expected without any error to create a new ingress, but got error: %v", err)
+		return
+	}
+
+	select {
+	case e := <-recorder.Events:
+		if !strings.HasPrefix(e, corev1.EventTypeNormal + " CreatedIngress") || !strings.Contains(e, "fake-events.fake-test.apps.example.com") {
+			t.Errorf("Expected a CreatedIngress normal event with the host, but got %s", e)
+		}
+	default:
+		t.Errorf("Expected a CreatedIngress normal event to be recorded, but got none")
+	}
+
+	ing.ServiceName = svc.Name
+	ing.Namespace = ns
+	if err := ing.DeleteIngress(); err != nil {
+		t.Errorf("Expected without any errors for deleting the ingress by service name %s, but got error: %v", svc.Name, err)
+	}
+
+	select {
+	case e := <-recorder.Events:
+		if !strings.HasPrefix(e, corev1.EventTypeNormal + " DeletedIngress") {
+			t.Errorf("Expected a DeletedIngress normal event, but got %s", e)
+		}
+	default:
+		t.Errorf("Expected a DeletedIngress normal event to be recorded, but got none")
+	}
+}
+
+func TestIngress_IngressWithStatus(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ns := "fake-test"
+	d := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "fake-status", Namespace: ns}}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: testConfig.ServicePrefix + "fake-status",
+			Namespace: ns,
+			Annotations: map[string]string{"pigo.io/part-of": testConfig.PartOf, "pigo.network/allow-internet-access": "true", "pigo.network/port": "http"},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "http", Port: int32(80)}},
+		},
+	}
+	client := fake.NewSimpleClientset(d)
+	infmrs := informers.NewSharedInformerFactory(client, 0)
+	ing := &Ingress{K8sClient: client, Version: NetworkingV1, Config: testConfig, Workloads: service.NewWorkloadListers(infmrs)}
+	ingInformer := Informer(infmrs, ing.Version)
+	infmrs.Start(ctx.Done())
+	infmrs.WaitForCacheSync(ctx.Done())
+	ing.Lister = NewLister(infmrs, ing.Version)
+	// The status is read from the caches, which are waited for between the steps
+	synced := func() {
+		_ = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+			d, _ := client.AppsV1().Deployments(ns).Get(context.TODO(), d.Name, metav1.GetOptions{})
+			ings, _ := client.NetworkingV1().Ingresses(ns).List(context.TODO(), metav1.ListOptions{})
+			cached, err := ing.Workloads.Deployments.Deployments(ns).Get(d.Name)
+			return err == nil && cached.ResourceVersion == d.ResourceVersion && len(ingInformer.GetStore().List()) == len(ings.Items), nil
+		})
+	}
+	status := func(k string) string {
+		synced()
+		d, _ := client.AppsV1().Deployments(ns).Get(context.TODO(), d.Name, metav1.GetOptions{})
+		return d.Annotations[k]
+	}
+
+	if err := ing.CreateIngress(svc); err != nil {
+		t.Errorf("Expected without any error to create a new ingress, but got error: %v", err)
+		return
+	}
+	if n := status("pigo.io/managed-ingress"); n != testConfig.IngressName(svc.Name) {
+		t.Errorf("Expected the deployment to be annotated with the ingress %s, but got %s", testConfig.IngressName(svc.Name), n)
+	}
+	if u := status("pigo.network/url"); u != "http://fake-status.fake-test.apps.example.com" {
+		t.Errorf("Expected the deployment to be annotated with the URL http://fake-status.fake-test.apps.example.com, but got %s", u)
+	}
+
+	// The URL follows the hostname of the service
+	svc.Annotations["pigo.network/hostname"] = "moved.apps.example.com"
+	if err := ing.UpsertIngress(svc); err != nil {
+		t.Errorf("Expected without any error to update the ingress, but got error: %v", err)
+		return
+	}
+	if u := status("pigo.network/url"); u != "http://moved.apps.example.com" {
+		t.Errorf("Expected the URL to follow the hostname to http://moved.apps.example.com, but got %s", u)
+	}
+
+	ing.ServiceName = svc.Name
+	ing.Namespace = ns
+	if err := ing.DeleteIngress(); err != nil {
+		t.Errorf("Expected without any errors for deleting the ingress by service name %s, but got error: %v", svc.Name, err)
+	}
+	if u := status("pigo.network/url"); u != "" {
+		t.Errorf("Expected the URL to be removed along with the ingress, but got %s", u)
+	}
+
+	// The status of a refused ingress is removed as well
+	if err := ing.CreateIngress(svc); err != nil {
+		t.Errorf("Expected without any error to create a new ingress, but got error: %v", err)
+		return
+	}
+	if u := status("pigo.network/url"); u != "http://moved.apps.example.com" {
+		t.Errorf("Expected the deployment to be annotated with the URL http://moved.apps.example.com, but got %s", u)
+	}
+	if err := client.NetworkingV1().Ingresses(ns).Delete(context.TODO(), testConfig.IngressName(svc.Name), metav1.DeleteOptions{}); err != nil {
+		t.Errorf("Expected without any errors for deleting the ingress, but got error: %v", err)
+		return
+	}
+	synced()
+	svc.Annotations["pigo.network/port"] = "missing"
+	if err := ing.UpsertIngress(svc); err != nil {
+		t.Errorf("Expected the ingress without port to be refused without error, but got error: %v", err)
+	}
+	if n := status("pigo.io/managed-ingress"); n != "" {
+		t.Errorf("Expected the ingress to be removed from the status of the deployment, but got %s", n)
+	}
+	if u := status("pigo.network/url"); u != "" {
+		t.Errorf("Expected the URL to be removed along with the refused ingress, but got %s", u)
+	}
+}
+
+func TestIngress_UpsertIngressWithdrawn(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ns := "fake-test"
+	d := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "fake-withdrawn", Namespace: ns}}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: testConfig.ServicePrefix + "fake-withdrawn",
+			Namespace: ns,
+			UID: types.UID("fake-withdrawn"),
+			Annotations: map[string]string{"pigo.io/part-of": testConfig.PartOf, "pigo.network/allow-internet-access": "true", "pigo.network/port": "http"},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "http", Port: int32(80)}},
+		},
+	}
+	client := fake.NewSimpleClientset(d)
+	infmrs := informers.NewSharedInformerFactory(client, 0)
+	ing := &Ingress{K8sClient: client, Version: NetworkingV1, Config: testConfig, Workloads: service.NewWorkloadListers(infmrs)}
+	ingInformer := Informer(infmrs, ing.Version)
+	infmrs.Start(ctx.Done())
+	infmrs.WaitForCacheSync(ctx.Done())
+	ing.Lister = NewLister(infmrs, ing.Version)
+	synced := func() {
+		_ = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+			d, _ := client.AppsV1().Deployments(ns).Get(context.TODO(), d.Name, metav1.GetOptions{})
+			ings, _ := client.NetworkingV1().Ingresses(ns).List(context.TODO(), metav1.ListOptions{})
+			cached, err := ing.Workloads.Deployments.Deployments(ns).Get(d.Name)
+			return err == nil && cached.ResourceVersion == d.ResourceVersion && len(ingInformer.GetStore().List()) == len(ings.Items), nil
+		})
+	}
+
+	if err := ing.UpsertIngress(svc); err != nil {
+		t.Errorf("Expected without any error to create a new ingress, but got error: %v", err)
+		return
+	}
+	synced()
+	d, _ = client.AppsV1().Deployments(ns).Get(context.TODO(), d.Name, metav1.GetOptions{})
+	if u := d.Annotations["pigo.network/url"]; u != "http://fake-withdrawn.fake-test.apps.example.com" {
+		t.Errorf("Expected the deployment to be annotated with the URL http://fake-withdrawn.fake-test.apps.example.com, but got %s", u)
+	}
+
+	// The service is no longer exposed to the internet
+	svc.Annotations["pigo.network/allow-internet-access"] = "false"
+	if err := ing.UpsertIngress(svc); err != nil {
+		t.Errorf("Expected without any error to delete the ingress, but got error: %v", err)
+		return
+	}
+	synced()
+	if ings, _ := client.NetworkingV1().Ingresses(ns).List(context.TODO(), metav1.ListOptions{}); len(ings.Items) != 0 {
+		t.Errorf("Expected the ingress of the service no longer exposed to be deleted, but got %d ingresses", len(ings.Items))
+	}
+	d, _ = client.AppsV1().Deployments(ns).Get(context.TODO(), d.Name, metav1.GetOptions{})
+	if u := d.Annotations["pigo.network/url"]; u != "" {
+		t.Errorf("Expected the URL to be removed along with the ingress, but got %s", u)
+	}
+	if n := d.Annotations["pigo.io/managed-ingress"]; n != "" {
+		t.Errorf("Expected the ingress to be removed from the status of the deployment, but got %s", n)
+	}
+
+	// The ingress of another service is left alone
+	other := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: testConfig.IngressName(svc.Name), Namespace: ns}}
+	if _, err := client.NetworkingV1().Ingresses(ns).Create(context.TODO(), other, metav1.CreateOptions{}); err != nil {
+		t.Errorf("Expected without any error to create the ingress, but got error: %v", err)
+		return
+	}
+	synced()
+	if err := ing.UpsertIngress(svc); err != nil {
+		t.Errorf("Expected without any error to leave the ingress, but got error: %v", err)
+	}
+	if ings, _ := client.NetworkingV1().Ingresses(ns).List(context.TODO(), metav1.ListOptions{}); len(ings.Items) != 1 {
+		t.Errorf("Expected the ingress not controlled by the service to be kept, but got %d ingresses", len(ings.Items))
+	}
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"github.com/pinative/k8s-bot/pkg/ingress"
+	"github.com/pinative/k8s-bot/pkg/policy"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+var managedDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "managed_objects"),
+	"Number of services and ingresses managed by the bot per namespace.", []string{"kind", "namespace"}, nil)
+
+// A ManagedCollector counts the services and ingresses managed by the bot
+// per namespace in the caches of the informers, when the metrics are
+// scraped.
+type ManagedCollector struct {
+	Services  corelisters.ServiceLister
+	Ingresses ingress.Lister
+	Policies  *policy.Store
+}
+
+// Describe implements prometheus.Collector.
+func (c *ManagedCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- managedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *ManagedCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := map[string]map[string]int{"Service": {}, "Ingress": {}}
+	managed := func(kind, ns string, annotations map[string]string) {
+		if annotations["pigo.io/part-of"] == c.Policies.Config(ns).PartOf && !c.Policies.IsExcluded(ns) {
+			counts[kind][ns]++
+		}
+	}
+
+	svcs, err := c.Services.List(labels.Everything())
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(managedDesc, err)
+		return
+	}
+	for _, svc := range svcs {
+		managed("Service", svc.Namespace, svc.Annotations)
+	}
+	ings, err := c.Ingresses.List("")
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(managedDesc, err)
+		return
+	}
+	for _, ing := range ings {
+		managed("Ingress", ing.Namespace, ing.Annotations)
+	}
+
+	for kind, namespaces := range counts {
+		for ns, n := range namespaces {
+			ch <- prometheus.MustNewConstMetric(managedDesc, prometheus.GaugeValue, float64(n), kind, ns)
+		}
+	}
+}
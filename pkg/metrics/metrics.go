@@ -0,0 +1,189 @@
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/client-go/tools/metrics"
+	"k8s.io/client-go/util/workqueue"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// namespace prefixes the names of the metrics of the bot.
+const namespace = "k8s_bot"
+
+var (
+	// Reconciles counts the keys reconciled by each controller, by result.
+	Reconciles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconciles_total",
+		Help:      "Number of reconciles per controller and result.",
+	}, []string{"controller", "result"})
+	// ReconcileDuration observes the duration of the reconciles of each
+	// controller.
+	ReconcileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "reconcile_duration_seconds",
+		Help:      "Duration of the reconciles per controller.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"controller"})
+	// Resyncs counts the objects delivered again by the periodic resync of
+	// each informer.
+	Resyncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "informer_resyncs_total",
+		Help:      "Number of unchanged objects delivered by the resync per informer.",
+	}, []string{"informer"})
+
+	apiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Latency of the requests to the API server per verb and resource.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"verb", "resource"})
+	apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_requests_total",
+		Help:      "Number of requests to the API server per method and status code.",
+	}, []string{"method", "code"})
+
+	workqueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "depth",
+		Help:      "Number of keys waiting in the workqueue.",
+	}, []string{"name"})
+	workqueueAdds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "adds_total",
+		Help:      "Number of keys added to the workqueue.",
+	}, []string{"name"})
+	workqueueLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "queue_duration_seconds",
+		Help:      "Duration a key waits in the workqueue before it is reconciled.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 10, 6),
+	}, []string{"name"})
+	workqueueWorkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "work_duration_seconds",
+		Help:      "Duration a key of the workqueue takes to be reconciled.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 10, 6),
+	}, []string{"name"})
+	workqueueUnfinishedWork = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "unfinished_work_seconds",
+		Help:      "Duration the keys of the workqueue in progress have been reconciled for.",
+	}, []string{"name"})
+	workqueueLongestRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "longest_running_processor_seconds",
+		Help:      "Duration the longest key of the workqueue in progress has been reconciled for.",
+	}, []string{"name"})
+	workqueueRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "retries_total",
+		Help:      "Number of keys requeued after a failed reconcile.",
+	}, []string{"name"})
+)
+
+func init() {
+	prometheus.MustRegister(Reconciles, ReconcileDuration, Resyncs, apiRequestDuration, apiRequests,
+		workqueueDepth, workqueueAdds, workqueueLatency, workqueueWorkDuration, workqueueUnfinishedWork,
+		workqueueLongestRunning, workqueueRetries)
+
+	// The queues and the clients pick their metrics up when they are created,
+	// the provider is set before any of them.
+	workqueue.SetProvider(workqueueProvider{})
+	metrics.Register(metrics.RegisterOpts{
+		RequestLatency: requestLatency{},
+		RequestResult:  requestResult{},
+	})
+}
+
+// Handler returns the handler serving the metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveReconcile records the reconcile of the controller started at start,
+// err is the error it returned.
+func ObserveReconcile(controller string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	Reconciles.WithLabelValues(controller, result).Inc()
+	ReconcileDuration.WithLabelValues(controller).Observe(time.Since(start).Seconds())
+}
+
+type requestLatency struct{}
+
+func (requestLatency) Observe(_ context.Context, verb string, u url.URL, latency time.Duration) {
+	apiRequestDuration.WithLabelValues(verb, resource(u.Path)).Observe(latency.Seconds())
+}
+
+type requestResult struct{}
+
+func (requestResult) Increment(_ context.Context, code, method, _ string) {
+	apiRequests.WithLabelValues(method, code).Inc()
+}
+
+// resource returns the resource of the API path p, the names of the objects
+// are left out of the labels.
+func resource(p string) string {
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	// /api/v1/... and /apis/group/version/...
+	switch {
+	case len(parts) > 2 && parts[0] == "api":
+		parts = parts[2:]
+	case len(parts) > 3 && parts[0] == "apis":
+		parts = parts[3:]
+	default:
+		return ""
+	}
+	if len(parts) > 2 && parts[0] == "namespaces" {
+		parts = parts[2:]
+	}
+
+	return parts[0]
+}
+
+type workqueueProvider struct{}
+
+func (workqueueProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return workqueueDepth.WithLabelValues(name)
+}
+
+func (workqueueProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return workqueueAdds.WithLabelValues(name)
+}
+
+func (workqueueProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return workqueueLatency.WithLabelValues(name)
+}
+
+func (workqueueProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return workqueueWorkDuration.WithLabelValues(name)
+}
+
+func (workqueueProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return workqueueUnfinishedWork.WithLabelValues(name)
+}
+
+func (workqueueProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return workqueueLongestRunning.WithLabelValues(name)
+}
+
+func (workqueueProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return workqueueRetries.WithLabelValues(name)
+}
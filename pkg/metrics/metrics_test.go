@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/pinative/k8s-bot/pkg/config"
+	"github.com/pinative/k8s-bot/pkg/ingress"
+	"github.com/pinative/k8s-bot/pkg/policy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResource(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/api/v1/services", "services"},
+		{"/api/v1/namespaces/fake-test/services/svc-fake-test", "services"},
+		{"/apis/apps/v1/namespaces/fake-test/deployments/fake-test", "deployments"},
+		{"/apis/networking.k8s.io/v1/ingresses", "ingresses"},
+		{"/api/v1/namespaces/fake-test", "namespaces"},
+		{"/version", ""},
+	}
+	for _, tt := range tests {
+		if got := resource(tt.path); got != tt.want {
+			t.Errorf("Expected the resource of %s to be %q, but got %q", tt.path, tt.want, got)
+		}
+	}
+}
+
+func TestObserveReconcile(t *testing.T) {
+	success := testutil.ToFloat64(Reconciles.WithLabelValues("fake", "success"))
+	failure := testutil.ToFloat64(Reconciles.WithLabelValues("fake", "error"))
+
+	ObserveReconcile("fake", time.Now(), nil)
+	ObserveReconcile("fake", time.Now(), errors.New("fake error"))
+	ObserveReconcile("fake", time.Now(), errors.New("fake error"))
+
+	if v := testutil.ToFloat64(Reconciles.WithLabelValues("fake", "success")) - success; v != 1 {
+		t.Errorf("Expected 1 successful reconcile, but got %v", v)
+	}
+	if v := testutil.ToFloat64(Reconciles.WithLabelValues("fake", "error")) - failure; v != 2 {
+		t.Errorf("Expected 2 failed reconciles, but got %v", v)
+	}
+}
+
+func TestManagedCollector(t *testing.T) {
+	conf := config.Default()
+	managed := map[string]string{"pigo.io/part-of": conf.PartOf}
+	client := fake.NewSimpleClientset(
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "fake-a", Namespace: "fake-test", Annotations: managed}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "fake-b", Namespace: "fake-test", Annotations: managed}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "fake-other", Namespace: "fake-test"}},
+		&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "fake-excluded", Namespace: "kube-system", Annotations: managed}},
+		&networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "fake-a", Namespace: "fake-test", Annotations: managed}},
+	)
+	f := informers.NewSharedInformerFactory(client, 0)
+	c := &ManagedCollector{
+		Services: f.Core().V1().Services().Lister(),
+		Ingresses: ingress.NewLister(f, ingress.NetworkingV1),
+		Policies: policy.NewStore(conf),
+	}
+	ingress.Informer(f, ingress.NetworkingV1)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	f.Start(stopCh)
+	f.WaitForCacheSync(stopCh)
+
+	expected := `
+# HELP k8s_bot_managed_objects Number of services and ingresses managed by the bot per namespace.
+# TYPE k8s_bot_managed_objects gauge
+k8s_bot_managed_objects{kind="Ingress",namespace="fake-test"} 1
+k8s_bot_managed_objects{kind="Service",namespace="fake-test"} 2
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected)); err != nil {
+		t.Errorf("Expected the managed objects of the fake-test namespace, but got error: %v", err)
+	}
+}
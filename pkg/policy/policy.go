@@ -0,0 +1,385 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"github.com/pinative/k8s-bot/pkg/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var (
+	// GroupVersion of the exposure policies.
+	GroupVersion = schema.GroupVersion{Group: "pigo.io", Version: "v1alpha1"}
+	// ClusterExposurePolicies configure the bot for the whole cluster.
+	ClusterExposurePolicies = GroupVersion.WithResource("clusterexposurepolicies")
+	// ExposurePolicies configure the exposure of the workloads of their namespace.
+	ExposurePolicies = GroupVersion.WithResource("exposurepolicies")
+)
+
+// Spec is the spec of the ClusterExposurePolicies and ExposurePolicies, every
+// field left empty falls back to the configuration of the bot.
+type Spec struct {
+	// ServicePrefix overrides the service prefix of the cluster.
+	ServicePrefix string `json:"servicePrefix,omitempty"`
+	// IngressPrefix overrides the ingress prefix of the cluster.
+	IngressPrefix string `json:"ingressPrefix,omitempty"`
+	// Domain overrides the public DNS domain.
+	Domain string `json:"domain,omitempty"`
+	// IngressClass overrides the ingress class.
+	IngressClass string `json:"ingressClass,omitempty"`
+	TLS          *TLS   `json:"tls,omitempty"`
+	// ServiceType overrides the default service type.
+	ServiceType string      `json:"serviceType,omitempty"`
+	Namespaces  *Namespaces `json:"namespaces,omitempty"`
+}
+
+// TLS configures the TLS of the ingresses.
+type TLS struct {
+	// SecretName overrides the TLS secret.
+	SecretName string `json:"secretName,omitempty"`
+	// ClusterIssuer overrides the cert-manager ClusterIssuer.
+	ClusterIssuer string `json:"clusterIssuer,omitempty"`
+	// ForceSSLRedirect overrides the HTTP to HTTPS redirection.
+	ForceSSLRedirect *bool `json:"forceSSLRedirect,omitempty"`
+}
+
+// Namespaces scope the namespaces managed by the bot, they are glob patterns.
+type Namespaces struct {
+	// Include restricts the bot to the namespaces, when not empty.
+	Include []string `json:"include,omitempty"`
+	// Exclude keeps the bot out of the namespaces.
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// apply overrides the configuration c with the spec, the prefixes are only
+// read from the ClusterExposurePolicies.
+func (s *Spec) apply(c *config.Config, namespaced bool) {
+	set := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+	if !namespaced {
+		set(&c.ServicePrefix, s.ServicePrefix)
+		set(&c.IngressPrefix, s.IngressPrefix)
+	}
+	set(&c.Domain, s.Domain)
+	set(&c.IngressClass, s.IngressClass)
+	set(&c.ServiceType, s.ServiceType)
+	if s.TLS != nil {
+		set(&c.TLSSecret, s.TLS.SecretName)
+		set(&c.TLSClusterIssuer, s.TLS.ClusterIssuer)
+		if s.TLS.ForceSSLRedirect != nil {
+			c.TLSForceSSLRedirect = *s.TLS.ForceSSLRedirect
+		}
+	}
+}
+
+// NamespaceDefaults are the annotations of a namespace overriding the
+// configuration of the bot for its workloads.
+var NamespaceDefaults = []string{
+	"pigo.network/domain",
+	"pigo.network/ingress-class",
+	"pigo.network/service-type",
+	"pigo.network/default-expose",
+}
+
+// ApplyNamespaceDefaults overrides the configuration c with the
+// NamespaceDefaults of the annotations of a namespace. It returns an error,
+// leaving c unchanged, when the configuration they result in is invalid.
+func ApplyNamespaceDefaults(c *config.Config, annotations map[string]string) error {
+	n := *c
+	if v := annotations["pigo.network/domain"]; v != "" {
+		n.Domain = v
+	}
+	if v := annotations["pigo.network/ingress-class"]; v != "" {
+		n.IngressClass = v
+	}
+	if v := annotations["pigo.network/service-type"]; v != "" {
+		n.ServiceType = v
+	}
+	if v := annotations["pigo.network/default-expose"]; v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid pigo.network/default-expose annotation %q", v)
+		}
+		n.DefaultExpose = b
+	}
+	if err := n.Validate(); err != nil {
+		return err
+	}
+	*c = n
+
+	return nil
+}
+
+// EqualNamespaceDefaults returns true if the NamespaceDefaults of the
+// annotations a and b are the same.
+func EqualNamespaceDefaults(a, b map[string]string) bool {
+	for _, k := range NamespaceDefaults {
+		if a[k] != b[k] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Served returns true if the CRDs of the policies are installed.
+func Served(client discovery.DiscoveryInterface) (bool, error) {
+	groups, err := client.ServerGroups()
+	if err != nil {
+		return false, err
+	}
+	for _, g := range groups.Groups {
+		for _, gv := range g.Versions {
+			if gv.GroupVersion == GroupVersion.String() {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// Load replaces the policies of the store with the ones listed by client, it
+// serves the one-shot commands which do not watch the policies.
+func (s *Store) Load(client dynamic.Interface) error {
+	policies := map[string]*entry{}
+	for _, r := range []schema.GroupVersionResource{ClusterExposurePolicies, ExposurePolicies} {
+		list, err := client.Resource(r).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+		for i := range list.Items {
+			obj := &list.Items[i]
+			spec, err := FromUnstructured(obj)
+			if err != nil {
+				return err
+			}
+			policies[obj.GetNamespace()+"/"+obj.GetName()] = &entry{namespace: obj.GetNamespace(), name: obj.GetName(), spec: spec}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies = policies
+
+	return nil
+}
+
+// FromUnstructured returns the spec of the policy obj.
+func FromUnstructured(obj *unstructured.Unstructured) (*Spec, error) {
+	spec := &Spec{}
+	m, ok := obj.Object["spec"].(map[string]interface{})
+	if !ok {
+		return spec, nil
+	}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(m, spec)
+
+	return spec, err
+}
+
+type entry struct {
+	namespace string
+	name      string
+	spec      *Spec
+}
+
+// A Store keeps the policies of the cluster over the configuration of the
+// bot, it is safe for concurrent use.
+type Store struct {
+	mu         sync.RWMutex
+	base       *config.Config
+	policies   map[string]*entry
+	namespaces corelisters.NamespaceLister
+}
+
+// NewStore returns a store without policy over the configuration base.
+func NewStore(base *config.Config) *Store {
+	return &Store{base: base, policies: map[string]*entry{}}
+}
+
+// Set adds or replaces the policy name of the namespace ns, ns is empty for
+// a ClusterExposurePolicy. The policy is refused when the configuration it
+// results in is invalid.
+func (s *Store) Set(ns, name string, spec *Spec) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := ns + "/" + name
+	old, ok := s.policies[key]
+	s.policies[key] = &entry{namespace: ns, name: name, spec: spec}
+	if err := s.config(ns).Validate(); err != nil {
+		if ok {
+			s.policies[key] = old
+		} else {
+			delete(s.policies, key)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// SetBase replaces the configuration of the bot under the policies. The
+// configuration is refused when the configuration of a namespace it results
+// in is invalid.
+func (s *Store) SetBase(base *config.Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.base
+	s.base = base
+	namespaces := map[string]bool{"": true}
+	for _, e := range s.policies {
+		namespaces[e.namespace] = true
+	}
+	for ns := range namespaces {
+		if err := s.config(ns).Validate(); err != nil {
+			s.base = old
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetNamespaces sets the lister the labels of the namespaces are read from,
+// the namespace selector of the configuration is ignored until it is set.
+func (s *Store) SetNamespaces(lister corelisters.NamespaceLister) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.namespaces = lister
+}
+
+// Delete removes the policy name of the namespace ns.
+func (s *Store) Delete(ns, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.policies, ns+"/"+name)
+}
+
+// Config returns the configuration of the namespace ns, the configuration
+// of the bot overridden by the ClusterExposurePolicies, by the
+// NamespaceDefaults of the annotations of ns, then by the ExposurePolicies of
+// ns. Policies of the same scope are applied in name order, the first one
+// wins. An empty ns returns the cluster configuration.
+func (s *Store) Config(ns string) *config.Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.config(ns)
+}
+
+// ConfigWithBase returns the configuration of the namespace ns if the
+// configuration of the bot was base.
+func (s *Store) ConfigWithBase(base *config.Config, ns string) *config.Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.configWithBase(base, ns)
+}
+
+// ConfigWithPolicy returns the cluster configuration if the policy name of
+// the namespace ns was spec, a nil spec deletes the policy.
+func (s *Store) ConfigWithPolicy(ns, name string, spec *Spec) *config.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := ns + "/" + name
+	old, ok := s.policies[key]
+	if spec == nil {
+		delete(s.policies, key)
+	} else {
+		s.policies[key] = &entry{namespace: ns, name: name, spec: spec}
+	}
+	c := s.config("")
+	if ok {
+		s.policies[key] = old
+	} else {
+		delete(s.policies, key)
+	}
+
+	return c
+}
+
+func (s *Store) config(ns string) *config.Config {
+	return s.configWithBase(s.base, ns)
+}
+
+func (s *Store) configWithBase(base *config.Config, ns string) *config.Config {
+	c := *base
+	cluster := s.sorted("")
+	for i := len(cluster) - 1; i >= 0; i-- {
+		cluster[i].spec.apply(&c, false)
+	}
+	if ns != "" && s.namespaces != nil {
+		// Invalid defaults are reported by the namespace controller
+		if n, err := s.namespaces.Get(ns); err == nil {
+			_ = ApplyNamespaceDefaults(&c, n.Annotations)
+		}
+	}
+	if ns != "" {
+		namespaced := s.sorted(ns)
+		for i := len(namespaced) - 1; i >= 0; i-- {
+			namespaced[i].spec.apply(&c, true)
+		}
+	}
+
+	return &c
+}
+
+// IsExcluded returns true if the configuration of the bot or the
+// ClusterExposurePolicies keep the bot out of the namespace ns. A namespace
+// unknown to the lister is excluded while a namespace selector is set.
+func (s *Store) IsExcluded(ns string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.base.IsExcludedNamespace(ns) {
+		return true
+	}
+	if s.base.NamespaceSelector != "" && s.namespaces != nil {
+		n, err := s.namespaces.Get(ns)
+		if err != nil || !s.base.Selector().Matches(labels.Set(n.Labels)) {
+			return true
+		}
+	}
+	for _, e := range s.sorted("") {
+		if e.spec.Namespaces == nil {
+			continue
+		}
+		if config.MatchNamespace(e.spec.Namespaces.Exclude, ns) {
+			return true
+		}
+		if len(e.spec.Namespaces.Include) > 0 && !config.MatchNamespace(e.spec.Namespaces.Include, ns) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Store) sorted(ns string) (entries []*entry) {
+	for _, e := range s.policies {
+		if e.namespace == ns {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	return
+}
@@ -0,0 +1,193 @@
+package policy
+
+import (
+	"github.com/pinative/k8s-bot/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+)
+
+func newTestConfig() *config.Config {
+	c := config.Default()
+	c.ServicePrefix = "svc-"
+	c.IngressClass = "nginx"
+	c.Domain = ".apps.example.com"
+
+	return c
+}
+
+func TestStore_Config(t *testing.T) {
+	s := NewStore(newTestConfig())
+
+	if v := s.Config("fake-test").IngressClass; v != "nginx" {
+		t.Errorf("Expected the ingress class to fall back to the configuration nginx, but got %s", v)
+	}
+
+	_ = s.Set("", "default", &Spec{ServicePrefix: "bot-", IngressClass: "traefik", Domain: ".cluster.example.com"})
+	_ = s.Set("fake-test", "default", &Spec{ServicePrefix: "ns-", IngressClass: "haproxy"})
+
+	if v := s.Config("fake-test").IngressClass; v != "haproxy" {
+		t.Errorf("Expected the ingress class of the namespace haproxy, but got %s", v)
+	}
+	if v := s.Config("fake-other").IngressClass; v != "traefik" {
+		t.Errorf("Expected the ingress class of the cluster traefik, but got %s", v)
+	}
+	if v := s.Config("fake-test").Domain; v != ".cluster.example.com" {
+		t.Errorf("Expected the domain of the cluster .cluster.example.com, but got %s", v)
+	}
+	// The prefixes are only read from the cluster policies
+	if v := s.Config("fake-test").ServicePrefix; v != "bot-" {
+		t.Errorf("Expected the service prefix of the cluster bot-, but got %s", v)
+	}
+
+	s.Delete("", "default")
+	if v := s.Config("").ServicePrefix; v != "svc-" {
+		t.Errorf("Expected the service prefix to fall back to the configuration svc-, but got %s", v)
+	}
+}
+
+func TestStore_Set(t *testing.T) {
+	s := NewStore(newTestConfig())
+	_ = s.Set("", "default", &Spec{IngressClass: "traefik"})
+
+	if err := s.Set("", "default", &Spec{ServicePrefix: "Invalid_"}); err == nil {
+		t.Errorf("Expected the invalid service prefix to be refused")
+	}
+	if v := s.Config("").IngressClass; v != "traefik" {
+		t.Errorf("Expected the previous policy to be kept, but got the ingress class %s", v)
+	}
+	if err := s.Set("fake-test", "default", &Spec{ServiceType: "ExternalName"}); err == nil {
+		t.Errorf("Expected the invalid service type to be refused")
+	}
+	if v := s.Config("fake-test").ServiceType; v != "" {
+		t.Errorf("Expected the refused policy not to be applied, but got the service type %s", v)
+	}
+}
+
+func TestStore_SetBase(t *testing.T) {
+	s := NewStore(newTestConfig())
+	_ = s.Set("fake-test", "default", &Spec{IngressClass: "haproxy"})
+
+	c := newTestConfig()
+	c.Domain = ".cluster.example.com"
+	if v := s.ConfigWithBase(c, "fake-test").Domain; v != ".cluster.example.com" {
+		t.Errorf("Expected the domain of the new configuration .cluster.example.com, but got %s", v)
+	}
+	if v := s.Config("fake-test").Domain; v != ".apps.example.com" {
+		t.Errorf("Expected the configuration not to be applied yet, but got the domain %s", v)
+	}
+
+	if err := s.SetBase(c); err != nil {
+		t.Errorf("Expected no errors occured to set the configuration, but got error: %v", err)
+	}
+	if v := s.Config("fake-test"); v.Domain != ".cluster.example.com" || v.IngressClass != "haproxy" {
+		t.Errorf("Expected the new configuration under the policies, but got %+v", v)
+	}
+
+	c = newTestConfig()
+	c.Workers = 0
+	if err := s.SetBase(c); err == nil {
+		t.Errorf("Expected the invalid configuration to be refused")
+	}
+	if v := s.Config("").Domain; v != ".cluster.example.com" {
+		t.Errorf("Expected the previous configuration to be kept, but got the domain %s", v)
+	}
+}
+
+func TestStore_IsExcluded(t *testing.T) {
+	s := NewStore(newTestConfig())
+	_ = s.Set("", "default", &Spec{Namespaces: &Namespaces{Include: []string{"fake-*"}, Exclude: []string{"fake-other"}}})
+
+	if s.IsExcluded("fake-test") {
+		t.Errorf("Expected the namespace fake-test to be included")
+	}
+	if !s.IsExcluded("fake-other") {
+		t.Errorf("Expected the namespace fake-other to be excluded")
+	}
+	if !s.IsExcluded("other-unknown") {
+		t.Errorf("Expected the namespace other-unknown out of the included ones to be excluded")
+	}
+}
+
+func TestStore_IsExcludedWithSelector(t *testing.T) {
+	c := newTestConfig()
+	c.NamespaceSelector = "k8s-bot.pigo.io/enabled=true"
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	_ = indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "fake-test", Labels: map[string]string{"k8s-bot.pigo.io/enabled": "true"}}})
+	_ = indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "fake-other"}})
+
+	s := NewStore(c)
+	s.SetNamespaces(corelisters.NewNamespaceLister(indexer))
+
+	if s.IsExcluded("fake-test") {
+		t.Errorf("Expected the namespace fake-test selected by its labels to be included")
+	}
+	if !s.IsExcluded("fake-other") {
+		t.Errorf("Expected the namespace fake-other without the label to be excluded")
+	}
+	if !s.IsExcluded("kube-system") {
+		t.Errorf("Expected the namespace kube-system to be excluded by default")
+	}
+}
+
+func TestStore_ConfigWithNamespaceDefaults(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	_ = indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "fake-test", Annotations: map[string]string{
+		"pigo.network/domain": ".team.example.com",
+		"pigo.network/ingress-class": "traefik",
+		"pigo.network/default-expose": "true",
+	}}})
+	_ = indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "fake-invalid", Annotations: map[string]string{
+		"pigo.network/domain": ".team_example.com",
+	}}})
+
+	s := NewStore(newTestConfig())
+	s.SetNamespaces(corelisters.NewNamespaceLister(indexer))
+	_ = s.Set("fake-test", "default", &Spec{IngressClass: "haproxy"})
+
+	c := s.Config("fake-test")
+	if c.Domain != ".team.example.com" || !c.DefaultExpose {
+		t.Errorf("Expected the defaults of the namespace annotations, but got %+v", c)
+	}
+	// The ExposurePolicies of the namespace take precedence
+	if c.IngressClass != "haproxy" {
+		t.Errorf("Expected the ingress class of the namespace policy haproxy, but got %s", c.IngressClass)
+	}
+	if v := s.Config("fake-invalid").Domain; v != ".apps.example.com" {
+		t.Errorf("Expected the invalid namespace defaults to be ignored, but got the domain %s", v)
+	}
+	if v := s.Config("").Domain; v != ".apps.example.com" {
+		t.Errorf("Expected the cluster configuration without namespace defaults, but got the domain %s", v)
+	}
+}
+
+func TestFromUnstructured(t *testing.T) {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "pigo.io/v1alpha1",
+		"kind": "ClusterExposurePolicy",
+		"metadata": map[string]interface{}{"name": "default"},
+		"spec": map[string]interface{}{
+			"domain": ".apps.example.com",
+			"tls": map[string]interface{}{"clusterIssuer": "letsencrypt", "forceSSLRedirect": true},
+		},
+	}}
+
+	spec, err := FromUnstructured(obj)
+	if err != nil {
+		t.Errorf("Expected no errors occured to convert the policy, but got error: %v", err)
+		return
+	}
+
+	c := newTestConfig()
+	c.TLSSecret = "fake-secret"
+	spec.apply(c, false)
+	if c.TLSClusterIssuer != "letsencrypt" || !c.TLSForceSSLRedirect {
+		t.Errorf("Expected the TLS settings of the policy, but got %+v", c)
+	}
+	if c.TLSSecret != "fake-secret" {
+		t.Errorf("Expected the TLS secret not to be overridden, but got %s", c.TLSSecret)
+	}
+}
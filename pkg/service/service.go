@@ -1,7 +1,9 @@
 package service
 
 import (
-	"errors"
+	"context"
+	"fmt"
+	"github.com/pinative/k8s-bot/pkg/config"
 	"github.com/rs/zerolog/log"
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
@@ -11,134 +13,526 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
-	"os"
+	"k8s.io/client-go/tools/record"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 )
 
+// managedAnnotations are the annotations of the service reconciled by the bot,
+// the others are left to the users.
+var managedAnnotations = []string{"pigo.io/part-of", "pigo.network/allow-internet-access", "pigo.network/hostname", "pigo.network/ingress-class", "pigo.network/tls", "pigo.network/port", loadBalancerAnnotationsAnnotation}
+
+// ingressAnnotations are copied from the deployment to the service, the
+// ingress of the service is configured by them.
+var ingressAnnotations = []string{"pigo.network/hostname", "pigo.network/ingress-class", "pigo.network/tls"}
+
+// loadBalancerAnnotationPrefixes are the prefixes of the annotations copied
+// from the deployment to a LoadBalancer service, they configure the cloud
+// load balancer.
+var loadBalancerAnnotationPrefixes = []string{"service.beta.kubernetes.io/", "service.kubernetes.io/", "cloud.google.com/"}
+
+// loadBalancerAnnotationsAnnotation lists the load balancer annotations the
+// bot copied to the service, the ones the deployment no longer sets are
+// removed from the service.
+const loadBalancerAnnotationsAnnotation = "pigo.io/load-balancer-annotations"
+
+// ServiceTypeHeadless is the pigo.network/service-type of a ClusterIP service
+// without cluster IP.
+const ServiceTypeHeadless = "Headless"
+
 type Service struct {
 	K8sClient kubernetes.Interface
+	// Config is the configuration of the namespace of the service.
+	Config *config.Config
 	Name string
 	Namespace string
+	// Recorder records the events on the workload of the service.
+	Recorder record.EventRecorder
 }
 
-func (s *Service) DeleteService(sif informers.SharedInformerFactory, l map[string]string) (err error) {
-	svcLister := sif.Core().V1().Services().Lister()
-	ns := s.Namespace
-	ret, err := svcLister.Services(ns).List(labels.Set(l).AsSelector())
-	if err != nil {
-		log.Error().Err(err).Msgf("onDelete - Error to list services by labels %v from namespace %s", l, ns)
-		return err
+// DeleteService deletes the service svc of a deleted workload, the other
+// services of the namespace are left alone. The service is only deleted when
+// it has not been replaced since it was read.
+func (s *Service) DeleteService(svc *v1.Service) (err error) {
+	deletePolicy := metav1.DeletePropagationForeground
+	err = s.K8sClient.CoreV1().Services(svc.Namespace).Delete(context.TODO(), svc.Name, metav1.DeleteOptions{
+		PropagationPolicy: &deletePolicy,
+		Preconditions:     metav1.NewUIDPreconditions(string(svc.UID)),
+	})
+	if k8serrors.IsNotFound(err) || k8serrors.IsConflict(err) {
+		return nil
 	}
-	for _, svc := range ret {
-		deletePolicy := metav1.DeletePropagationForeground
-		err := s.K8sClient.CoreV1().Services(ns).Delete(svc.Name, &metav1.DeleteOptions{
-			PropagationPolicy: &deletePolicy,
-		})
-		if err != nil {
-			log.Error().Err(err).Msgf("onDelete - Error to delete the service %s in namespace %s", svc.Name, ns)
-			return err
-		}
+	if err != nil {
+		log.Error().Err(err).Msgf("onDelete - Error to delete the service %s in namespace %s", svc.Name, svc.Namespace)
 	}
 
 	return
 }
 
-func (s *Service) UpsertService(sfi informers.SharedInformerFactory, ol map[string]string, newDeploy *appsv1.Deployment, oldDeploy *appsv1.Deployment) (err error) {
-	if len(ol) == 0 {
-		return errors.New("invalid arguments, the labels should not be empty")
+// Reconcile computes the desired service of the deployment and creates it,
+// or updates the existing one when it has drifted from the desired state.
+func (s *Service) Reconcile(sif informers.SharedInformerFactory, d *appsv1.Deployment) (err error) {
+	w := DeploymentWorkload(d)
+	// As long as one or more available replicas alive
+	//  then create a service for that deployment
+	return s.reconcile(sif, w, newService(s.Config, w), w.ReadyReplicas > 0)
+}
+
+// ReconcileStatefulSet reconciles the service of the statefulset like the one
+// of a deployment, and the headless service governing the statefulset named
+// in its spec.serviceName.
+func (s *Service) ReconcileStatefulSet(sif informers.SharedInformerFactory, sts *appsv1.StatefulSet) (err error) {
+	w := StatefulSetWorkload(sts)
+	if err = s.reconcile(sif, w, newService(s.Config, w), w.ReadyReplicas > 0); err != nil {
+		return
+	}
+	if sts.Spec.ServiceName == "" || sts.Spec.ServiceName == s.Config.ServiceName(sts.Name) {
+		return
 	}
 
-	svcLister := sfi.Core().V1().Services().Lister()
-	ns := s.Namespace
-	services, err := svcLister.Services(ns).List(labels.Set(ol).AsSelector())
-	if err != nil {
-		log.Error().Err(err).Msgf("Error to list services by labels %v from namespace %s", ol, ns)
-		return err
+	// The pods get their DNS names from the governing service, so it is
+	// created before any of them is ready
+	return s.reconcile(sif, w, newGoverningService(s.Config, w, sts.Spec.ServiceName), true)
+}
+
+// ReconcileDaemonSet reconciles the service of the daemonset like the one of
+// a deployment.
+func (s *Service) ReconcileDaemonSet(sif informers.SharedInformerFactory, ds *appsv1.DaemonSet) (err error) {
+	w := DaemonSetWorkload(ds)
+	return s.reconcile(sif, w, newService(s.Config, w), w.ReadyReplicas > 0)
+}
+
+// reconcile creates the desired service of the workload w when create is
+// true, or updates the existing one when it has drifted from it.
+func (s *Service) reconcile(sif informers.SharedInformerFactory, w *Workload, desired *v1.Service, create bool) (err error) {
+	if len(desired.Spec.Ports) == 0 {
+		s.refuseService(w, desired)
+		return s.patchStatus(w, desired, false)
 	}
-	// As long as one or more available replicas alive
-	//  then create a service for that deployment
-	if len(services) == 0 && newDeploy.Status.AvailableReplicas > 0 {
-		svc := newService(newDeploy)
-		_, err = s.K8sClient.CoreV1().Services(newDeploy.GetNamespace()).Create(svc)
-		if err != nil && !k8serrors.IsAlreadyExists(err) {
+	current, err := sif.Core().V1().Services().Lister().Services(desired.Namespace).Get(desired.Name)
+	if k8serrors.IsNotFound(err) {
+		if !create {
+			return s.patchStatus(w, desired, false)
+		}
+		_, err = s.K8sClient.CoreV1().Services(desired.Namespace).Create(context.TODO(), desired, metav1.CreateOptions{})
+		if k8serrors.IsAlreadyExists(err) {
+			return nil
+		}
+		if err != nil {
 			log.Error().
 				Err(err).
-				Str("namespace", svc.Namespace).
-				Str("name", svc.Name).
+				Str("namespace", desired.Namespace).
+				Str("name", desired.Name).
 				Send()
+			s.event(w, v1.EventTypeWarning, "FailedCreateService", "Service %s was not created: %v", desired.Name, err)
 			return err
 		}
+		s.event(w, v1.EventTypeNormal, "CreatedService", "Service %s was created", desired.Name)
+		return s.patchStatus(w, desired, true)
+	}
+	if err != nil {
+		return err
+	}
+	// A service of the user is never taken over, unless it is annotated to be
+	if metav1.GetControllerOf(current) == nil && current.Annotations["pigo.io/part-of"] != s.Config.PartOf {
+		log.Warn().
+			Str("namespace", current.Namespace).
+			Str("name", current.Name).
+			Msg("service is not managed by the bot")
+		s.event(w, v1.EventTypeWarning, "ServiceConflict", "Service %s was not reconciled: it already exists and is not annotated with pigo.io/part-of", current.Name)
+		return s.patchStatus(w, desired, false)
+	}
+	// A deployment and a statefulset of the same name would fight over it
+	if ref := metav1.GetControllerOf(current); ref != nil && ref.Kind != w.Kind {
+		log.Warn().
+			Str("namespace", current.Namespace).
+			Str("name", current.Name).
+			Msgf("service is controlled by %s %s", ref.Kind, ref.Name)
+		s.event(w, v1.EventTypeWarning, "ServiceConflict", "Service %s was not reconciled: it is controlled by %s %s", current.Name, ref.Kind, ref.Name)
+		return s.patchStatus(w, desired, false)
+	}
 
-	} else if oldDeploy.ResourceVersion != newDeploy.ResourceVersion && !reflect.DeepEqual(ol, newDeploy.GetLabels()) {
-		for _, svc := range services {
-			svc.Labels = newDeploy.Labels
-			svc.Spec.Selector = newDeploy.GetLabels()
-			_, err = s.K8sClient.CoreV1().Services(ns).Update(svc)
-			if err != nil {
-				log.Error().
-					Err(err).
-					Str("namespace", svc.Namespace).
-					Str("name", svc.Name).
-					Send()
-				return err
-			}
+	diffs := diffService(current, desired)
+	if len(diffs) == 0 {
+		return s.patchStatus(w, desired, true)
+	}
+	log.Warn().
+		Str("namespace", current.Namespace).
+		Str("name", current.Name).
+		Strs("diff", diffs).
+		Msg("service drifted from the desired state")
+
+	// The cluster IP is immutable, a service turned into or out of a headless
+	// one has to be created again
+	if isHeadless(current) != isHeadless(desired) {
+		if err = s.recreateService(w, current, desired); err != nil {
+			return
 		}
+		return s.patchStatus(w, desired, true)
 	}
 
+	svc := current.DeepCopy()
+	svc.Labels = desired.Labels
+	if svc.Annotations == nil {
+		svc.Annotations = map[string]string{}
+	}
+	// The load balancer annotations the deployment no longer sets are removed
+	for _, k := range loadBalancerAnnotations(current) {
+		if _, ok := desired.Annotations[k]; !ok {
+			delete(svc.Annotations, k)
+		}
+	}
+	for _, k := range managedAnnotations {
+		if v, ok := desired.Annotations[k]; ok {
+			svc.Annotations[k] = v
+		} else {
+			delete(svc.Annotations, k)
+		}
+	}
+	for k, v := range desired.Annotations {
+		if isLoadBalancerAnnotation(k) {
+			svc.Annotations[k] = v
+		}
+	}
+	svc.Spec.Selector = desired.Spec.Selector
+	svc.Spec.Ports = mergeServicePorts(current.Spec.Ports, desired.Spec.Ports, desired.Spec.Type)
+	svc.Spec.Type = desired.Spec.Type
+	svc.Spec.LoadBalancerSourceRanges = desired.Spec.LoadBalancerSourceRanges
+	// The external traffic policy is only allowed on the services exposed on
+	// the nodes, and the health check node port on the local load balancers
+	svc.Spec.ExternalTrafficPolicy = externalTrafficPolicy(desired)
+	if svc.Spec.Type != v1.ServiceTypeLoadBalancer || svc.Spec.ExternalTrafficPolicy != v1.ServiceExternalTrafficPolicyTypeLocal {
+		svc.Spec.HealthCheckNodePort = 0
+	}
+	itp := internalTrafficPolicy(desired)
+	svc.Spec.InternalTrafficPolicy = &itp
+	svc.OwnerReferences = adoptOwnerReferences(current.OwnerReferences, desired.OwnerReferences[0])
+	_, err = s.K8sClient.CoreV1().Services(svc.Namespace).Update(context.TODO(), svc, metav1.UpdateOptions{})
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("namespace", svc.Namespace).
+			Str("name", svc.Name).
+			Send()
+		s.event(w, v1.EventTypeWarning, "FailedUpdateService", "Service %s was not updated: %v", svc.Name, err)
+		return
+	}
+	s.event(w, v1.EventTypeNormal, "UpdatedService", "Service %s was updated: %s", svc.Name, strings.Join(diffs, ", "))
+
+	return s.patchStatus(w, desired, true)
+}
+
+// recreateService deletes the current service of the workload w and creates
+// the desired one in its place. The ingress of the service is deleted along
+// with it, and created again by the service controller.
+func (s *Service) recreateService(w *Workload, current, desired *v1.Service) (err error) {
+	// The current service has to be gone before its name can be reused
+	deletePolicy := metav1.DeletePropagationBackground
+	err = s.K8sClient.CoreV1().Services(current.Namespace).Delete(context.TODO(), current.Name, metav1.DeleteOptions{
+		PropagationPolicy: &deletePolicy,
+		Preconditions:     &metav1.Preconditions{UID: &current.UID},
+	})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		log.Error().
+			Err(err).
+			Str("namespace", current.Namespace).
+			Str("name", current.Name).
+			Send()
+		s.event(w, v1.EventTypeWarning, "FailedDeleteService", "Service %s was not deleted to be created again: %v", current.Name, err)
+		return err
+	}
+
+	_, err = s.K8sClient.CoreV1().Services(desired.Namespace).Create(context.TODO(), desired, metav1.CreateOptions{})
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("namespace", desired.Namespace).
+			Str("name", desired.Name).
+			Send()
+		s.event(w, v1.EventTypeWarning, "FailedCreateService", "Service %s was deleted but not created again: %v", desired.Name, err)
+		return err
+	}
+	log.Printf("SERVICE %s/%s was RECREATED", desired.Namespace, desired.Name)
+	s.event(w, v1.EventTypeNormal, "RecreatedService", "Service %s was created again to change its cluster IP", desired.Name)
+
 	return
 }
 
-func GetServicePort(sn string, ports []v1.ServicePort) int32 {
-	for _, p := range ports {
-		svcPrefix := os.Getenv("BOT_SERVICE_PREFIX")
-		n := strings.TrimPrefix(sn, svcPrefix)
-		pn := getServicePortName(svcPrefix, n)
-		if pn == p.Name {
-			return p.Port
+// refuseService records a warning on the workload w instead of creating or
+// updating its service svc without any port.
+func (s *Service) refuseService(w *Workload, svc *v1.Service) {
+	log.Warn().
+		Str("namespace", svc.Namespace).
+		Str("name", svc.Name).
+		Msg("no container port to expose")
+	s.event(w, v1.EventTypeWarning, "NoServicePort",
+		"Service %s was not reconciled: the container %q declares no port", svc.Name, w.Annotations["pigo.io/container"])
+}
+
+// event records an event on the workload w when the service has a recorder.
+func (s *Service) event(w *Workload, eventType, reason, messageFmt string, args ...interface{}) {
+	if s.Recorder != nil {
+		s.Recorder.Eventf(w.objectReference(), eventType, reason, messageFmt, args...)
+	}
+}
+
+// NewOwnerReference returns the controller reference of the service of d.
+func NewOwnerReference(d *appsv1.Deployment) *metav1.OwnerReference {
+	return metav1.NewControllerRef(d, appsv1.SchemeGroupVersion.WithKind("Deployment"))
+}
+
+// WorkloadReference returns the reference of the workload svc was created for
+// with the configuration c, events about the service are recorded on it.
+func WorkloadReference(c *config.Config, svc *v1.Service) *v1.ObjectReference {
+	ref := &v1.ObjectReference{
+		APIVersion: appsv1.SchemeGroupVersion.String(),
+		Kind:       "Deployment",
+		Namespace:  svc.Namespace,
+		Name:       c.WorkloadName(svc.Name),
+	}
+	if owner := metav1.GetControllerOf(svc); owner != nil && owner.APIVersion == ref.APIVersion {
+		ref.Kind = owner.Kind
+		ref.Name = owner.Name
+		ref.UID = owner.UID
+	}
+
+	return ref
+}
+
+// GetIngressPortName returns the name of the port of svc the ingress is routed
+// to, or an empty string when the service has no such port.
+func GetIngressPortName(c *config.Config, svc *v1.Service) string {
+	pn := svc.Annotations["pigo.network/port"]
+	if pn == "" {
+		// Services created before the annotation name the port by convention
+		pn = getServicePortName(c.ServicePrefix, c.WorkloadName(svc.Name))
+	}
+	for _, p := range svc.Spec.Ports {
+		if p.Name == pn {
+			return pn
 		}
 	}
 
-	return 0
+	return ""
 }
 
-func newService(d *appsv1.Deployment) *v1.Service {
-	c := getSpecificContainer("main", d.Spec.Template.Spec.Containers)
-	port := getHttpContainerPort(c)
-	svcPrefix := os.Getenv("BOT_SERVICE_PREFIX")
+func newService(conf *config.Config, d *Workload) *v1.Service {
+	cn := d.Annotations["pigo.io/container"]
+	if cn == "" {
+		cn = "main"
+	}
+	c := getSpecificContainer(cn, d.Template.Spec.Containers)
+	ports, pn := getServicePorts(conf.ServicePrefix, d.Name, c, d.Annotations["pigo.network/port"])
 
 	aia := d.Annotations["pigo.network/allow-internet-access"]
 	if aia == "" {
-		aia = "false"
+		aia = strconv.FormatBool(conf.DefaultExpose)
+	}
+	annots := map[string]string{"pigo.io/part-of":conf.PartOf, "pigo.network/allow-internet-access":aia}
+	for _, k := range ingressAnnotations {
+		if v := d.Annotations[k]; v != "" {
+			annots[k] = v
+		}
+	}
+	// The ingress is routed to the port named by the annotation
+	if pn != "" {
+		annots["pigo.network/port"] = pn
 	}
-	annots := map[string]string{"pigo.io/part-of":os.Getenv("ANNOT_PIGO_IO_PARTOF"), "pigo.network/allow-internet-access":aia}
 
-	return &v1.Service{
+	svc := &v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: svcPrefix +  d.GetName(),
+			Name: conf.ServiceName(d.GetName()),
 			Namespace: d.GetNamespace(),
 			Labels: d.GetLabels(),
 			Annotations: annots,
+			// The service is garbage collected along with its workload
+			OwnerReferences: []metav1.OwnerReference{*d.ownerReference()},
 		},
 		Spec: v1.ServiceSpec{
-			Ports: []v1.ServicePort{
-				{
-					Name: getServicePortName(svcPrefix, d.Name),
-					Protocol: v1.ProtocolTCP,
-					Port: port,
-					TargetPort: intstr.IntOrString{Type: intstr.Int, IntVal: port},
-				},
-			},
+			Ports: ports,
 			Type: v1.ServiceTypeClusterIP,
 			Selector: d.GetLabels(),
 		},
 	}
+	t := d.Annotations["pigo.network/service-type"]
+	if t == "" {
+		t = conf.ServiceType
+	}
+	setServiceType(svc, t, d.Annotations, pn)
+	setTrafficPolicies(svc, d.Annotations)
+
+	return svc
+}
+
+// newGoverningService returns the headless service named sn governing the
+// statefulset w, it is never exposed to the internet.
+func newGoverningService(c *config.Config, w *Workload, sn string) *v1.Service {
+	svc := newService(c, w)
+	svc.Name = sn
+	svc.Annotations = map[string]string{"pigo.io/part-of": c.PartOf, "pigo.network/allow-internet-access": "false"}
+	svc.Spec.Type = v1.ServiceTypeClusterIP
+	svc.Spec.ClusterIP = v1.ClusterIPNone
+	// The fields of the node ports and the load balancers are refused on a
+	// ClusterIP service
+	svc.Spec.LoadBalancerSourceRanges = nil
+	svc.Spec.ExternalTrafficPolicy = ""
+	svc.Spec.HealthCheckNodePort = 0
+	for i := range svc.Spec.Ports {
+		svc.Spec.Ports[i].NodePort = 0
+	}
+
+	return svc
+}
+
+// setServiceType sets the type t of svc, an unknown type leaves the service
+// as ClusterIP. The node port of a NodePort or LoadBalancer service is pinned
+// on the port named pn.
+func setServiceType(svc *v1.Service, t string, annots map[string]string, pn string) {
+	switch t {
+	case "", string(v1.ServiceTypeClusterIP):
+		return
+	case ServiceTypeHeadless:
+		svc.Spec.ClusterIP = v1.ClusterIPNone
+		return
+	case string(v1.ServiceTypeNodePort), string(v1.ServiceTypeLoadBalancer):
+		svc.Spec.Type = v1.ServiceType(t)
+	default:
+		log.Warn().
+			Str("namespace", svc.Namespace).
+			Str("name", svc.Name).
+			Msgf("unknown service type %s", t)
+		return
+	}
+
+	if np, err := strconv.Atoi(annots["pigo.network/node-port"]); err == nil {
+		for i := range svc.Spec.Ports {
+			if svc.Spec.Ports[i].Name == pn {
+				svc.Spec.Ports[i].NodePort = int32(np)
+			}
+		}
+	}
+	if svc.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return
+	}
+	if sr := annots["pigo.network/load-balancer-source-ranges"]; sr != "" {
+		for _, r := range strings.Split(sr, ",") {
+			svc.Spec.LoadBalancerSourceRanges = append(svc.Spec.LoadBalancerSourceRanges, strings.TrimSpace(r))
+		}
+	}
+	var keys []string
+	for k, v := range annots {
+		if isLoadBalancerAnnotation(k) {
+			svc.Annotations[k] = v
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) > 0 {
+		sort.Strings(keys)
+		svc.Annotations[loadBalancerAnnotationsAnnotation] = strings.Join(keys, ",")
+	}
+}
+
+// setTrafficPolicies sets the traffic policies of svc from the annotations,
+// e.g. Local keeps the traffic on the node it entered, to the pod of a
+// daemonset running there.
+func setTrafficPolicies(svc *v1.Service, annots map[string]string) {
+	if p := annots["pigo.network/internal-traffic-policy"]; p != "" {
+		itp := v1.ServiceInternalTrafficPolicyType(p)
+		svc.Spec.InternalTrafficPolicy = &itp
+	}
+	if p := annots["pigo.network/external-traffic-policy"]; p != "" &&
+		(svc.Spec.Type == v1.ServiceTypeNodePort || svc.Spec.Type == v1.ServiceTypeLoadBalancer) {
+		svc.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyType(p)
+	}
+}
+
+// externalTrafficPolicy returns the external traffic policy of svc, which
+// defaults to Cluster on the services exposed on the nodes.
+func externalTrafficPolicy(svc *v1.Service) v1.ServiceExternalTrafficPolicyType {
+	if svc.Spec.Type != v1.ServiceTypeNodePort && svc.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return ""
+	}
+	if svc.Spec.ExternalTrafficPolicy == "" {
+		return v1.ServiceExternalTrafficPolicyTypeCluster
+	}
+
+	return svc.Spec.ExternalTrafficPolicy
+}
+
+// internalTrafficPolicy returns the internal traffic policy of svc, which
+// defaults to Cluster.
+func internalTrafficPolicy(svc *v1.Service) v1.ServiceInternalTrafficPolicyType {
+	if svc.Spec.InternalTrafficPolicy == nil {
+		return v1.ServiceInternalTrafficPolicyCluster
+	}
+
+	return *svc.Spec.InternalTrafficPolicy
+}
+
+// loadBalancerAnnotations returns the load balancer annotations the bot
+// copied to svc.
+func loadBalancerAnnotations(svc *v1.Service) []string {
+	if v := svc.Annotations[loadBalancerAnnotationsAnnotation]; v != "" {
+		return strings.Split(v, ",")
+	}
+
+	return nil
+}
+
+func isLoadBalancerAnnotation(k string) bool {
+	for _, p := range loadBalancerAnnotationPrefixes {
+		if strings.HasPrefix(k, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isHeadless(svc *v1.Service) bool {
+	return svc.Spec.ClusterIP == v1.ClusterIPNone
 }
 
 func getServicePortName(sp, n string) string {
 	return sp + "port-" + n
 }
 
+// getServicePorts returns a service port for every port of the container c,
+// and the name of the one the ingress is routed to, selected by sel. An
+// unnamed ingress port is named after the deployment n.
+func getServicePorts(sp, n string, c v1.Container, sel string) (ports []v1.ServicePort, ingressPort string) {
+	ip := getIngressContainerPort(c, sel)
+	for i, cp := range c.Ports {
+		if cp.ContainerPort == 0 {
+			continue
+		}
+		protocol := cp.Protocol
+		if protocol == "" {
+			protocol = v1.ProtocolTCP
+		}
+		name := cp.Name
+		if name == "" && i == ip {
+			name = getServicePortName(sp, n)
+		} else if name == "" {
+			name = fmt.Sprintf("%s-%d", strings.ToLower(string(protocol)), cp.ContainerPort)
+		}
+		if i == ip {
+			ingressPort = name
+		}
+
+		ports = append(ports, v1.ServicePort{
+			Name: name,
+			Protocol: protocol,
+			Port: cp.ContainerPort,
+			TargetPort: intstr.IntOrString{Type: intstr.Int, IntVal: cp.ContainerPort},
+		})
+	}
+
+	return
+}
+
 func getSpecificContainer(cn string, c []v1.Container) v1.Container {
 	if len(c) == 1 {
 		return c[0]
@@ -153,16 +547,125 @@ func getSpecificContainer(cn string, c []v1.Container) v1.Container {
 	return v1.Container{}
 }
 
-func getHttpContainerPort(c v1.Container) int32 {
-	if len(c.Ports) == 1 {
-		return c.Ports[0].ContainerPort
+// getIngressContainerPort returns the index of the TCP port of the container c
+// selected by sel, a port number or name, or the only port or the one named
+// http when sel is empty. It returns -1 when no port is selected.
+func getIngressContainerPort(c v1.Container, sel string) int {
+	for i, p := range c.Ports {
+		if p.Protocol != "" && p.Protocol != v1.ProtocolTCP {
+			continue
+		}
+		switch {
+		case sel == "" && (len(c.Ports) == 1 || p.Name == "http"):
+			return i
+		case sel != "" && (p.Name == sel || strconv.Itoa(int(p.ContainerPort)) == sel):
+			return i
+		}
 	}
 
-	for _, p := range c.Ports {
-		if p.Name == "http" {
-			return p.ContainerPort
+	return -1
+}
+
+// diffService returns the fields of the current service which differ from
+// the desired one, annotations not managed by the bot are left out.
+func diffService(current, desired *v1.Service) (diffs []string) {
+	if !labels.Equals(current.Labels, desired.Labels) {
+		diffs = append(diffs, fmt.Sprintf("metadata.labels: %v -> %v", current.Labels, desired.Labels))
+	}
+	for _, k := range managedAnnotations {
+		cv, cok := current.Annotations[k]
+		dv, dok := desired.Annotations[k]
+		if cv != dv || cok != dok {
+			diffs = append(diffs, fmt.Sprintf("metadata.annotations[%s]: %q -> %q", k, cv, dv))
 		}
 	}
+	if ref := metav1.GetControllerOf(current); ref == nil || ref.UID != desired.OwnerReferences[0].UID {
+		diffs = append(diffs, fmt.Sprintf("metadata.ownerReferences: %v -> %s/%s", ref, desired.OwnerReferences[0].Kind, desired.OwnerReferences[0].Name))
+	}
+	if !labels.Equals(current.Spec.Selector, desired.Spec.Selector) {
+		diffs = append(diffs, fmt.Sprintf("spec.selector: %v -> %v", current.Spec.Selector, desired.Spec.Selector))
+	}
+	if current.Spec.Type != desired.Spec.Type {
+		diffs = append(diffs, fmt.Sprintf("spec.type: %s -> %s", current.Spec.Type, desired.Spec.Type))
+	}
+	if isHeadless(current) != isHeadless(desired) {
+		diffs = append(diffs, fmt.Sprintf("spec.clusterIP: %s -> %s", current.Spec.ClusterIP, desired.Spec.ClusterIP))
+	}
+	if cp, dp := externalTrafficPolicy(current), externalTrafficPolicy(desired); cp != dp && dp != "" {
+		diffs = append(diffs, fmt.Sprintf("spec.externalTrafficPolicy: %s -> %s", cp, dp))
+	}
+	if cp, dp := internalTrafficPolicy(current), internalTrafficPolicy(desired); cp != dp {
+		diffs = append(diffs, fmt.Sprintf("spec.internalTrafficPolicy: %s -> %s", cp, dp))
+	}
+	if !reflect.DeepEqual(current.Spec.LoadBalancerSourceRanges, desired.Spec.LoadBalancerSourceRanges) &&
+		len(current.Spec.LoadBalancerSourceRanges)+len(desired.Spec.LoadBalancerSourceRanges) > 0 {
+		diffs = append(diffs, fmt.Sprintf("spec.loadBalancerSourceRanges: %v -> %v", current.Spec.LoadBalancerSourceRanges, desired.Spec.LoadBalancerSourceRanges))
+	}
+	for k, dv := range desired.Annotations {
+		if cv := current.Annotations[k]; isLoadBalancerAnnotation(k) && cv != dv {
+			diffs = append(diffs, fmt.Sprintf("metadata.annotations[%s]: %q -> %q", k, cv, dv))
+		}
+	}
+	for _, k := range loadBalancerAnnotations(current) {
+		_, dok := desired.Annotations[k]
+		if cv, cok := current.Annotations[k]; cok && !dok {
+			diffs = append(diffs, fmt.Sprintf("metadata.annotations[%s]: %q -> \"\"", k, cv))
+		}
+	}
+	if len(current.Spec.Ports) != len(desired.Spec.Ports) {
+		diffs = append(diffs, fmt.Sprintf("spec.ports: %d ports -> %d ports", len(current.Spec.Ports), len(desired.Spec.Ports)))
+		return
+	}
+	for i, dp := range desired.Spec.Ports {
+		cp := current.Spec.Ports[i]
+		if cp.Name != dp.Name {
+			diffs = append(diffs, fmt.Sprintf("spec.ports[%d].name: %s -> %s", i, cp.Name, dp.Name))
+		}
+		if cp.Protocol != dp.Protocol {
+			diffs = append(diffs, fmt.Sprintf("spec.ports[%d].protocol: %s -> %s", i, cp.Protocol, dp.Protocol))
+		}
+		if cp.Port != dp.Port {
+			diffs = append(diffs, fmt.Sprintf("spec.ports[%d].port: %d -> %d", i, cp.Port, dp.Port))
+		}
+		if cp.TargetPort != dp.TargetPort {
+			diffs = append(diffs, fmt.Sprintf("spec.ports[%d].targetPort: %s -> %s", i, cp.TargetPort.String(), dp.TargetPort.String()))
+		}
+		if dp.NodePort != 0 && cp.NodePort != dp.NodePort {
+			diffs = append(diffs, fmt.Sprintf("spec.ports[%d].nodePort: %d -> %d", i, cp.NodePort, dp.NodePort))
+		}
+	}
+
+	return
+}
+
+// mergeServicePorts returns the desired ports keeping the node ports already
+// allocated to the current ones when the service type still exposes them.
+func mergeServicePorts(current, desired []v1.ServicePort, t v1.ServiceType) []v1.ServicePort {
+	ports := make([]v1.ServicePort, len(desired))
+	for i, dp := range desired {
+		ports[i] = dp
+		if t != v1.ServiceTypeNodePort && t != v1.ServiceTypeLoadBalancer {
+			continue
+		}
+		for _, cp := range current {
+			if cp.Name == dp.Name && dp.NodePort == 0 {
+				ports[i].NodePort = cp.NodePort
+			}
+		}
+	}
+
+	return ports
+}
 
-	return 0
-}
\ No newline at end of file
+// adoptOwnerReferences replaces the controller reference of refs by owner,
+// the other references are kept.
+func adoptOwnerReferences(refs []metav1.OwnerReference, owner metav1.OwnerReference) []metav1.OwnerReference {
+	adopted := []metav1.OwnerReference{owner}
+	for _, ref := range refs {
+		if ref.Controller == nil || !*ref.Controller {
+			adopted = append(adopted, ref)
+		}
+	}
+
+	return adopted
+}
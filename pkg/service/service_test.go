@@ -2,28 +2,28 @@ package service
 
 import (
 	"context"
+	"fmt"
+	"github.com/pinative/k8s-bot/pkg/config"
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 	"k8s.io/client-go/tools/cache"
-	"log"
-	"os"
+	"k8s.io/client-go/tools/record"
 	"reflect"
+	"strings"
 	"testing"
 )
 
-func init() {
-	log.Println("Setting environment variable for Service testing")
-	_ = os.Setenv("BOT_SERVICE_PREFIX", "svc-")
-	_ = os.Setenv("BOT_INGRESS_PREFIX", "ing-")
-}
+var testConfig = &config.Config{PartOf: "k8s.bot", ServicePrefix: "svc-", IngressPrefix: "ing-", Domain: ".apps.example.com", HostnameStrategy: "template"}
 
 func newFakeService() *v1.Service {
 	return &v1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: os.Getenv("BOT_SERVICE_PREFIX") + "fake-service",
+			Name: testConfig.ServicePrefix + "fake-service",
 			Namespace: "fake-test",
 			Labels: map[string]string{"test-service": "true"},
 		},
@@ -39,175 +39,650 @@ func newFakeService() *v1.Service {
 }
 
 func TestService_DeleteService(t *testing.T) {
+	// A service of the user sharing the labels of the managed one
+	bystander := newFakeService()
+	bystander.Name = "fake-metrics"
+	client := fake.NewSimpleClientset(newFakeService(), bystander)
+
+	fakeSvc := Service{
+		K8sClient: client,
+		Config: testConfig,
+		Namespace: "fake-test",
+	}
+
+	err := fakeSvc.DeleteService(newFakeService())
+	if err != nil {
+		t.Errorf("Expected without any error to delete the service, but got error: %v", err)
+	}
+
+	sl, err := fakeSvc.K8sClient.CoreV1().Services(fakeSvc.Namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Errorf("Expected no error occurs to list services from informers, but got error %v", err)
+	}
+
+	if len(sl.Items) != 1 || sl.Items[0].Name != bystander.Name {
+		t.Errorf("Expected only the service %s to be left, but got %v", bystander.Name, sl.Items)
+	}
+}
+
+func TestService_ReconcileWithDrift(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	client := fake.NewSimpleClientset(newFakeService())
+	nd := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "fake-test",
+			Namespace: "fake-test",
+			Labels: map[string]string{"app": "fake-test"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: v1.PodTemplateSpec{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{Name: "main", Ports: []v1.ContainerPort{{ContainerPort: int32(8080)}}},
+					},
+				},
+			},
+		},
+	}
+
+	// A service manually edited to another port and selector
+	fs := newService(testConfig, DeploymentWorkload(nd))
+	fs.Spec.Ports[0].Port = int32(81)
+	fs.Spec.Selector = map[string]string{"app": "other"}
+	client := fake.NewSimpleClientset(fs)
 	infmrs := informers.NewSharedInformerFactory(client, 0)
 	svcInformer := infmrs.Core().V1().Services().Informer()
 	infmrs.Start(ctx.Done())
 	cache.WaitForCacheSync(ctx.Done(), svcInformer.HasSynced)
 
+	if diffs := diffService(fs, newService(testConfig, DeploymentWorkload(nd))); len(diffs) != 2 {
+		t.Errorf("Expected 2 drifted fields, but got %v", diffs)
+	}
+
 	fakeSvc := Service{
 		K8sClient: client,
+		Config: testConfig,
 		Namespace: "fake-test",
 	}
-	l := map[string]string{"test-service": "true"}
+	err := fakeSvc.Reconcile(infmrs, nd)
+	if err != nil {
+		t.Errorf("Expected no errors occured to reconcile the service, but got error: %v", err)
+	}
 
-	err := fakeSvc.DeleteService(infmrs, l)
+	svc, err := client.CoreV1().Services(fs.Namespace).Get(context.TODO(), fs.Name, metav1.GetOptions{})
 	if err != nil {
-		t.Errorf("Expected without any error to delete the service by labels %v", l)
+		t.Errorf("Expected no errors to get the service %s, but got error: %v", fs.Name, err)
+		return
+	}
+
+	if svc.Spec.Ports[0].Port != 8080 {
+		t.Errorf("Expected the service port to be reconciled to 8080, but got %v", svc.Spec.Ports[0].Port)
+	}
+
+	if !reflect.DeepEqual(svc.Spec.Selector, nd.GetLabels()) {
+		t.Errorf("Expected the service selector to be reconciled to %v, but got %v", nd.GetLabels(), svc.Spec.Selector)
+	}
+}
+
+func TestGetServicePorts(t *testing.T) {
+	c := v1.Container{
+		Name: "main",
+		Ports: []v1.ContainerPort{
+			{Name: "http", ContainerPort: int32(8080)},
+			{Name: "metrics", ContainerPort: int32(9090)},
+			{ContainerPort: int32(53), Protocol: v1.ProtocolUDP},
+		},
+	}
+
+	ports, pn := getServicePorts("svc-", "fake-test", c, "")
+	if len(ports) != 3 {
+		t.Errorf("Expected a service port for every container port, but got %v", ports)
+		return
+	}
+
+	if pn != "http" || ports[0].Name != "http" || ports[0].Port != 8080 || ports[0].Protocol != v1.ProtocolTCP {
+		t.Errorf("Expected the ingress to be routed to the http port, but got %s in %v", pn, ports[0])
+	}
+
+	if ports[1].Name != "metrics" || ports[1].TargetPort.IntVal != 9090 {
+		t.Errorf("Expected the metrics port name to be preserved, but got %v", ports[1])
+	}
+
+	if ports[2].Name != "udp-53" || ports[2].Protocol != v1.ProtocolUDP {
+		t.Errorf("Expected the unnamed UDP port to be named udp-53, but got %v", ports[2])
+	}
+}
+
+func TestService_ReconcileWithoutPort(t *testing.T) {
+	nd := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "fake-test",
+			Namespace: "fake-test",
+		},
+		Status: appsv1.DeploymentStatus{
+			AvailableReplicas: 1,
+		},
 	}
+	client := fake.NewSimpleClientset()
+	infmrs := informers.NewSharedInformerFactory(client, 0)
+	recorder := record.NewFakeRecorder(1)
 
-	sl, err := fakeSvc.K8sClient.CoreV1().Services(fakeSvc.Namespace).List(metav1.ListOptions{})
+	fakeSvc := Service{
+		K8sClient: client,
+		Config: testConfig,
+		Namespace: "fake-test",
+		Recorder: recorder,
+	}
+	err := fakeSvc.Reconcile(infmrs, nd)
 	if err != nil {
-		t.Errorf("Expected no error occurs to list services from informers, but got error %v", err)
+		t.Errorf("Expected no errors occured to reconcile the service, but got error: %v", err)
 	}
 
+	sl, _ := client.CoreV1().Services(nd.Namespace).List(context.TODO(), metav1.ListOptions{})
 	if len(sl.Items) > 0 {
-		t.Errorf("Expected empty services, but got %v", len(sl.Items))
+		t.Errorf("Expected no service to be created without port, but got %v", sl.Items)
+	}
+
+	select {
+	case e := <-recorder.Events:
+		if !strings.HasPrefix(e, v1.EventTypeWarning + " NoServicePort") {
+			t.Errorf("Expected a NoServicePort warning event, but got %s", e)
+		}
+	default:
+		t.Errorf("Expected a NoServicePort warning event to be recorded, but got none")
+	}
+}
+
+func TestService_ReconcileWithEvents(t *testing.T) {
+	nd := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "fake-test",
+			Namespace: "fake-test",
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: v1.PodTemplateSpec{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{Name: "main", Ports: []v1.ContainerPort{{ContainerPort: int32(8080)}}},
+					},
+				},
+			},
+		},
+		Status: appsv1.DeploymentStatus{
+			AvailableReplicas: 1,
+		},
+	}
+	client := fake.NewSimpleClientset()
+	recorder := record.NewFakeRecorder(1)
+
+	fakeSvc := Service{
+		K8sClient: client,
+		Config: testConfig,
+		Namespace: "fake-test",
+		Recorder: recorder,
+	}
+	if err := fakeSvc.Reconcile(informers.NewSharedInformerFactory(client, 0), nd); err != nil {
+		t.Errorf("Expected no errors occured to reconcile the service, but got error: %v", err)
+	}
+
+	select {
+	case e := <-recorder.Events:
+		if !strings.HasPrefix(e, v1.EventTypeNormal + " CreatedService") {
+			t.Errorf("Expected a CreatedService normal event, but got %s", e)
+		}
+	default:
+		t.Errorf("Expected a CreatedService normal event to be recorded, but got none")
+	}
+
+	// The failures of the API are reported on the deployment as well
+	client = fake.NewSimpleClientset()
+	client.PrependReactor("create", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("fake API error")
+	})
+	fakeSvc.K8sClient = client
+	if err := fakeSvc.Reconcile(informers.NewSharedInformerFactory(client, 0), nd); err == nil {
+		t.Errorf("Expected the error of the API to be returned")
+	}
+
+	select {
+	case e := <-recorder.Events:
+		if !strings.HasPrefix(e, v1.EventTypeWarning + " FailedCreateService") || !strings.Contains(e, "fake API error") {
+			t.Errorf("Expected a FailedCreateService warning event with the error, but got %s", e)
+		}
+	default:
+		t.Errorf("Expected a FailedCreateService warning event to be recorded, but got none")
 	}
 }
 
-func TestService_UpsertServiceWithServiceCreation(t *testing.T) {
+func TestService_ReconcileWithUserService(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	client := fake.NewSimpleClientset(newFakeService())
+	nd := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "fake-test",
+			Namespace: "fake-test",
+			Labels: map[string]string{"app": "fake-test"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: v1.PodTemplateSpec{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{Name: "main", Ports: []v1.ContainerPort{{ContainerPort: int32(8080)}}},
+					},
+				},
+			},
+		},
+		Status: appsv1.DeploymentStatus{
+			AvailableReplicas: 1,
+		},
+	}
+	// A service of the user with the name of the service of the deployment
+	us := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: testConfig.ServiceName(nd.Name),
+			Namespace: "fake-test",
+		},
+		Spec: v1.ServiceSpec{
+			Selector: map[string]string{"app": "other"},
+			Ports: []v1.ServicePort{{Name: "metrics", Port: int32(9090)}},
+		},
+	}
+	client := fake.NewSimpleClientset(us)
 	infmrs := informers.NewSharedInformerFactory(client, 0)
 	svcInformer := infmrs.Core().V1().Services().Informer()
 	infmrs.Start(ctx.Done())
 	cache.WaitForCacheSync(ctx.Done(), svcInformer.HasSynced)
+	recorder := record.NewFakeRecorder(1)
 
 	fakeSvc := Service{
 		K8sClient: client,
+		Config: testConfig,
 		Namespace: "fake-test",
+		Recorder: recorder,
+	}
+	if err := fakeSvc.Reconcile(infmrs, nd); err != nil {
+		t.Errorf("Expected no errors occured to reconcile the service, but got error: %v", err)
+	}
+
+	svc, _ := client.CoreV1().Services(us.Namespace).Get(context.TODO(), us.Name, metav1.GetOptions{})
+	if !reflect.DeepEqual(svc.Spec, us.Spec) || len(svc.OwnerReferences) != 0 {
+		t.Errorf("Expected the service of the user to be left alone, but got %v", svc)
+	}
+	select {
+	case e := <-recorder.Events:
+		if !strings.HasPrefix(e, v1.EventTypeWarning + " ServiceConflict") {
+			t.Errorf("Expected a ServiceConflict warning event, but got %s", e)
+		}
+	default:
+		t.Errorf("Expected a ServiceConflict warning event to be recorded, but got none")
+	}
+
+	// The service annotated by the user is taken over
+	us.Annotations = map[string]string{"pigo.io/part-of": testConfig.PartOf}
+	if err := svcInformer.GetStore().Update(us); err != nil {
+		t.Errorf("Expected no errors to update the cached service, but got error: %v", err)
+		return
+	}
+	if err := fakeSvc.Reconcile(infmrs, nd); err != nil {
+		t.Errorf("Expected no errors occured to reconcile the service, but got error: %v", err)
+	}
+	svc, _ = client.CoreV1().Services(us.Namespace).Get(context.TODO(), us.Name, metav1.GetOptions{})
+	if ref := metav1.GetControllerOf(svc); ref == nil || ref.Name != nd.Name {
+		t.Errorf("Expected the annotated service to be taken over by the deployment %s, but got %v", nd.Name, ref)
 	}
+}
 
-	ol := map[string]string{"test-new-service": "true"}
+func TestService_ReconcileWithStatus(t *testing.T) {
 	nd := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: "fake-deploy-name",
+			Name: "fake-test",
 			Namespace: "fake-test",
-			Labels: map[string]string{"fake-label-key": "fake-value"},
-			Annotations: map[string]string{"pigo.network/allow-internet-access": "false"},
+			Annotations: map[string]string{"pigo.io/part-of": testConfig.PartOf},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: v1.PodTemplateSpec{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{Name: "main", Ports: []v1.ContainerPort{{ContainerPort: int32(8080)}}},
+					},
+				},
+			},
 		},
 		Status: appsv1.DeploymentStatus{
 			AvailableReplicas: 1,
 		},
 	}
-	od := &appsv1.Deployment{}
-	err := fakeSvc.UpsertService(infmrs, ol, nd, od)
-	if err != nil {
-		t.Errorf("Expected no errors occured to update the service, but got error: %v", err)
+	client := fake.NewSimpleClientset(nd)
+
+	fakeSvc := Service{
+		K8sClient: client,
+		Config: testConfig,
+		Namespace: "fake-test",
+	}
+	if err := fakeSvc.Reconcile(informers.NewSharedInformerFactory(client, 0), nd); err != nil {
+		t.Errorf("Expected no errors occured to reconcile the service, but got error: %v", err)
 	}
 
-	svcName := os.Getenv("BOT_SERVICE_PREFIX") + nd.Name
-	svc, err := fakeSvc.K8sClient.CoreV1().Services(fakeSvc.Namespace).Get(svcName, metav1.GetOptions{})
-	if err != nil {
-		t.Errorf("Expected no errors to get the service %s, but got error: %v", svcName, err)
+	d, _ := client.AppsV1().Deployments(nd.Namespace).Get(context.TODO(), nd.Name, metav1.GetOptions{})
+	if sn := d.Annotations[ManagedServiceAnnotation]; sn != testConfig.ServiceName(nd.Name) {
+		t.Errorf("Expected the deployment to be annotated with the service %s, but got %s", testConfig.ServiceName(nd.Name), sn)
+	}
+	if d.Annotations[LastReconcileAnnotation] == "" {
+		t.Errorf("Expected the deployment to be annotated with the time of the reconcile")
+	}
+
+	// The status is removed once the deployment is left by the bot
+	delete(d.Annotations, "pigo.io/part-of")
+	if err := fakeSvc.ClearStatus(DeploymentWorkload(d)); err != nil {
+		t.Errorf("Expected no errors occured to clear the status, but got error: %v", err)
+	}
+	d, _ = client.AppsV1().Deployments(nd.Namespace).Get(context.TODO(), nd.Name, metav1.GetOptions{})
+	for _, k := range statusAnnotations {
+		if v, ok := d.Annotations[k]; ok {
+			t.Errorf("Expected the %s annotation to be removed, but got %s", k, v)
+		}
+	}
+}
+
+func TestNewServiceWithContainerAndPortAnnotations(t *testing.T) {
+	nd := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "fake-test",
+			Namespace: "fake-test",
+			Annotations: map[string]string{"pigo.io/container": "app", "pigo.network/port": "9000"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: v1.PodTemplateSpec{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{Name: "envoy", Ports: []v1.ContainerPort{{Name: "http", ContainerPort: int32(15001)}}},
+						{Name: "app", Ports: []v1.ContainerPort{{Name: "http", ContainerPort: int32(8080)}, {ContainerPort: int32(9000)}}},
+					},
+				},
+			},
+		},
+	}
+
+	svc := newService(testConfig, DeploymentWorkload(nd))
+	if len(svc.Spec.Ports) != 2 || svc.Spec.Ports[0].Port != 8080 {
+		t.Errorf("Expected the ports of the app container to be exposed, but got %v", svc.Spec.Ports)
+		return
+	}
+
+	if pn := GetIngressPortName(testConfig, svc); pn != "svc-port-fake-test" || svc.Spec.Ports[1].Name != pn {
+		t.Errorf("Expected the ingress to be routed to the port 9000 named svc-port-fake-test, but got %s", pn)
+	}
+}
+
+func TestNewServiceWithServiceType(t *testing.T) {
+	nd := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "fake-test",
+			Namespace: "fake-test",
+			Annotations: map[string]string{
+				"pigo.network/service-type": "LoadBalancer",
+				"pigo.network/node-port": "30080",
+				"pigo.network/load-balancer-source-ranges": "10.0.0.0/8, 192.168.0.0/16",
+				"service.beta.kubernetes.io/aws-load-balancer-internal": "true",
+			},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: v1.PodTemplateSpec{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{Name: "main", Ports: []v1.ContainerPort{{ContainerPort: int32(8080)}}},
+					},
+				},
+			},
+		},
+	}
+
+	svc := newService(testConfig, DeploymentWorkload(nd))
+	if svc.Spec.Type != v1.ServiceTypeLoadBalancer {
+		t.Errorf("Expected the service type to be LoadBalancer, but got %s", svc.Spec.Type)
+	}
+
+	if svc.Spec.Ports[0].NodePort != 30080 {
+		t.Errorf("Expected the node port to be 30080, but got %v", svc.Spec.Ports[0].NodePort)
+	}
+
+	if !reflect.DeepEqual(svc.Spec.LoadBalancerSourceRanges, []string{"10.0.0.0/8", "192.168.0.0/16"}) {
+		t.Errorf("Expected the load balancer source ranges to be set, but got %v", svc.Spec.LoadBalancerSourceRanges)
+	}
+
+	if svc.Annotations["service.beta.kubernetes.io/aws-load-balancer-internal"] != "true" {
+		t.Errorf("Expected the cloud load balancer annotations to be passed through, but got %v", svc.Annotations)
+	}
+
+	nd.Annotations = map[string]string{"pigo.network/service-type": "Headless"}
+	svc = newService(testConfig, DeploymentWorkload(nd))
+	if svc.Spec.Type != v1.ServiceTypeClusterIP || svc.Spec.ClusterIP != v1.ClusterIPNone {
+		t.Errorf("Expected a headless service, but got type %s with cluster IP %s", svc.Spec.Type, svc.Spec.ClusterIP)
+	}
+}
+
+func TestNewGoverningServiceWithServiceType(t *testing.T) {
+	ss := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "fake-sts",
+			Namespace: "fake-test",
+			Annotations: map[string]string{
+				"pigo.network/service-type": "LoadBalancer",
+				"pigo.network/node-port": "30080",
+				"pigo.network/external-traffic-policy": "Local",
+				"pigo.network/load-balancer-source-ranges": "10.0.0.0/8",
+				"service.beta.kubernetes.io/aws-load-balancer-internal": "true",
+			},
+		},
+		Spec: appsv1.StatefulSetSpec{
+			ServiceName: "fake-sts-headless",
+			Template: v1.PodTemplateSpec{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{Name: "main", Ports: []v1.ContainerPort{{ContainerPort: int32(8080)}}},
+					},
+				},
+			},
+		},
 	}
-	t.Logf("svc returned %v", svc)
 
-	if svc == nil {
-		t.Errorf("Expected returns the created service, but got nil")
+	// The governing service is headless whatever the type of the service of the statefulset
+	svc := newGoverningService(testConfig, StatefulSetWorkload(ss), ss.Spec.ServiceName)
+	if svc.Spec.Type != v1.ServiceTypeClusterIP || svc.Spec.ClusterIP != v1.ClusterIPNone {
+		t.Errorf("Expected a headless service, but got type %s with cluster IP %s", svc.Spec.Type, svc.Spec.ClusterIP)
+	}
+	if svc.Spec.ExternalTrafficPolicy != "" || svc.Spec.HealthCheckNodePort != 0 {
+		t.Errorf("Expected no external traffic policy on the headless service, but got %s with health check node port %d", svc.Spec.ExternalTrafficPolicy, svc.Spec.HealthCheckNodePort)
+	}
+	if svc.Spec.Ports[0].NodePort != 0 || svc.Spec.LoadBalancerSourceRanges != nil {
+		t.Errorf("Expected no node port nor load balancer source ranges, but got %d and %v", svc.Spec.Ports[0].NodePort, svc.Spec.LoadBalancerSourceRanges)
+	}
+	if _, ok := svc.Annotations["service.beta.kubernetes.io/aws-load-balancer-internal"]; ok {
+		t.Errorf("Expected no load balancer annotations, but got %v", svc.Annotations)
 	}
 }
 
-func TestService_UpsertServiceWithServiceUpdate(t *testing.T) {
+func TestService_ReconcileWithStaleLoadBalancerAnnotations(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	fs := newFakeService()
+	nd := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "fake-test",
+			Namespace: "fake-test",
+			Annotations: map[string]string{
+				"pigo.network/service-type": "LoadBalancer",
+				"service.beta.kubernetes.io/aws-load-balancer-internal": "true",
+				"service.beta.kubernetes.io/aws-load-balancer-type": "nlb",
+			},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: v1.PodTemplateSpec{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{Name: "main", Ports: []v1.ContainerPort{{ContainerPort: int32(8080)}}},
+					},
+				},
+			},
+		},
+	}
+	fs := newService(testConfig, DeploymentWorkload(nd))
+	// An annotation set on the service by the user is left alone
+	fs.Annotations["service.beta.kubernetes.io/aws-load-balancer-name"] = "fake-lb"
 	client := fake.NewSimpleClientset(fs)
 	infmrs := informers.NewSharedInformerFactory(client, 0)
 	svcInformer := infmrs.Core().V1().Services().Informer()
 	infmrs.Start(ctx.Done())
 	cache.WaitForCacheSync(ctx.Done(), svcInformer.HasSynced)
 
+	// The deployment drops one annotation, then the load balancer
+	nd.Annotations = map[string]string{"service.beta.kubernetes.io/aws-load-balancer-type": "nlb"}
+	diffs := diffService(fs, newService(testConfig, DeploymentWorkload(nd)))
+	if !strings.Contains(strings.Join(diffs, "\n"), "metadata.annotations[service.beta.kubernetes.io/aws-load-balancer-internal]") {
+		t.Errorf("Expected the removed load balancer annotation to be reported, but got %v", diffs)
+	}
+
 	fakeSvc := Service{
 		K8sClient: client,
+		Config: testConfig,
 		Namespace: "fake-test",
 	}
+	if err := fakeSvc.Reconcile(infmrs, nd); err != nil {
+		t.Errorf("Expected no errors occured to reconcile the service, but got error: %v", err)
+	}
+
+	svc, err := client.CoreV1().Services(fs.Namespace).Get(context.TODO(), fs.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("Expected no errors to get the service %s, but got error: %v", fs.Name, err)
+		return
+	}
+	for _, k := range []string{"service.beta.kubernetes.io/aws-load-balancer-internal", "service.beta.kubernetes.io/aws-load-balancer-type"} {
+		if v, ok := svc.Annotations[k]; ok {
+			t.Errorf("Expected the annotation %s to be removed along with the load balancer, but got %s", k, v)
+		}
+	}
+	if v := svc.Annotations["service.beta.kubernetes.io/aws-load-balancer-name"]; v != "fake-lb" {
+		t.Errorf("Expected the annotation set by the user to be kept, but got %s", v)
+	}
+}
 
-	ol := map[string]string{"test-service": "true"}
+func TestNewServiceWithDefaultExpose(t *testing.T) {
 	nd := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
-			Labels: map[string]string{"fake-new-label-key": "fake-value"},
-			ResourceVersion: "25654644",
+			Name: "fake-test",
+			Namespace: "fake-test",
 		},
-	}
-	od := &appsv1.Deployment{
-		ObjectMeta: metav1.ObjectMeta{
-			ResourceVersion: "25654622",
+		Spec: appsv1.DeploymentSpec{
+			Template: v1.PodTemplateSpec{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{Name: "main", Ports: []v1.ContainerPort{{ContainerPort: int32(8080)}}},
+					},
+				},
+			},
 		},
 	}
-	err := fakeSvc.UpsertService(infmrs, ol, nd, od)
-	if err != nil {
-		t.Errorf("Expected no errors occured to update the service, but got error: %v", err)
-	}
+	conf := *testConfig
+	conf.DefaultExpose = true
 
-	svc, err := fakeSvc.K8sClient.CoreV1().Services(fakeSvc.Namespace).Get(fs.Name, metav1.GetOptions{})
-	if err != nil {
-		t.Errorf("Expected no errors to get the service %s, but got error: %v", fs.Name, err)
+	svc := newService(&conf, DeploymentWorkload(nd))
+	if svc.Annotations["pigo.network/allow-internet-access"] != "true" {
+		t.Errorf("Expected the service to be exposed by default, but got %v", svc.Annotations)
 	}
 
-	if !reflect.DeepEqual(svc.GetLabels(), nd.GetLabels()) {
-		t.Errorf("Expected returns labels %v from the new service, but got %v", nd.Labels, svc.GetLabels())
+	// The annotation of the deployment takes precedence
+	nd.Annotations = map[string]string{"pigo.network/allow-internet-access": "false"}
+	svc = newService(&conf, DeploymentWorkload(nd))
+	if svc.Annotations["pigo.network/allow-internet-access"] != "false" {
+		t.Errorf("Expected the service not to be exposed, but got %v", svc.Annotations)
 	}
 }
 
-func TestService_UpsertServiceWithEmptyLabels(t *testing.T) {
+func TestService_ReconcileWithHeadless(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	client := fake.NewSimpleClientset(newFakeService())
+	nd := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "fake-test",
+			Namespace: "fake-test",
+			Labels: map[string]string{"app": "fake-test"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: v1.PodTemplateSpec{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{Name: "main", Ports: []v1.ContainerPort{{ContainerPort: int32(8080)}}},
+					},
+				},
+			},
+		},
+	}
+
+	// A service with a cluster IP allocated can not be turned into a headless one
+	fs := newService(testConfig, DeploymentWorkload(nd))
+	fs.UID = "fake-svc-uid"
+	fs.Spec.ClusterIP = "10.96.0.10"
+	client := fake.NewSimpleClientset(fs)
 	infmrs := informers.NewSharedInformerFactory(client, 0)
 	svcInformer := infmrs.Core().V1().Services().Informer()
 	infmrs.Start(ctx.Done())
 	cache.WaitForCacheSync(ctx.Done(), svcInformer.HasSynced)
 
+	nd.Annotations = map[string]string{"pigo.network/service-type": "Headless"}
 	fakeSvc := Service{
 		K8sClient: client,
+		Config: testConfig,
 		Namespace: "fake-test",
 	}
-
-	ol := map[string]string{}
-	nd := &appsv1.Deployment{}
-	od := &appsv1.Deployment{}
-	err := fakeSvc.UpsertService(infmrs, ol, nd, od)
-	if err == nil {
-		t.Errorf("Expected an invalid arguments error to be returned, but did not.")
+	err := fakeSvc.Reconcile(infmrs, nd)
+	if err != nil {
+		t.Errorf("Expected no errors occured to reconcile the service, but got error: %v", err)
 	}
-}
 
-func TestGetServicePortWithoutError(t *testing.T) {
-	sn := "svc-fake-test"
-	ports := []v1.ServicePort{
-		{
-			Name: "svc-port-fake-test",
-			Port: int32(80),
-		},
+	svc, err := client.CoreV1().Services(fs.Namespace).Get(context.TODO(), fs.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("Expected no errors to get the service %s, but got error: %v", fs.Name, err)
+		return
 	}
 
-	p := GetServicePort(sn, ports)
-	if p != 80 {
-		t.Errorf("Expected service port to be 80, but got %v", p)
+	if svc.Spec.ClusterIP != v1.ClusterIPNone || svc.UID == fs.UID {
+		t.Errorf("Expected the service to be recreated as a headless service, but got cluster IP %s", svc.Spec.ClusterIP)
 	}
 }
 
-func TestGetServicePortWithError(t *testing.T) {
-	sn := "svc-fake-svc-test"
-	ports := []v1.ServicePort{
-		{
-			Name: "svc-port-fake-test",
-			Port: int32(80),
+func TestDiffServiceWithTrafficPolicies(t *testing.T) {
+	nd := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "fake-test",
+			Namespace: "fake-test",
+			Annotations: map[string]string{"pigo.network/service-type": "NodePort"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: v1.PodTemplateSpec{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{
+						{Name: "main", Ports: []v1.ContainerPort{{ContainerPort: int32(8080)}}},
+					},
+				},
+			},
 		},
 	}
 
-	p := GetServicePort(sn, ports)
-	t.Logf("port returned %v", p)
-	if p == 80 {
-		t.Errorf("Expected service port to be 0, but got %v", p)
+	// The policies defaulted by the API server are not a drift
+	current := newService(testConfig, DeploymentWorkload(nd))
+	itp := v1.ServiceInternalTrafficPolicyCluster
+	current.Spec.InternalTrafficPolicy = &itp
+	current.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeCluster
+	if diffs := diffService(current, newService(testConfig, DeploymentWorkload(nd))); len(diffs) != 0 {
+		t.Errorf("Expected no drifted fields, but got %v", diffs)
 	}
-}
\ No newline at end of file
+
+	nd.Annotations["pigo.network/external-traffic-policy"] = "Local"
+	nd.Annotations["pigo.network/internal-traffic-policy"] = "Local"
+	if diffs := diffService(current, newService(testConfig, DeploymentWorkload(nd))); len(diffs) != 2 {
+		t.Errorf("Expected 2 drifted fields, but got %v", diffs)
+	}
+}
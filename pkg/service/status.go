@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	"time"
+)
+
+// The status annotations are written by the bot on the workloads it manages.
+const (
+	// URLAnnotation is the URL the workload is exposed at by its ingress.
+	URLAnnotation = "pigo.network/url"
+	// ManagedServiceAnnotation is the name of the service of the workload.
+	ManagedServiceAnnotation = "pigo.io/managed-service"
+	// ManagedIngressAnnotation is the name of the ingress of the workload.
+	ManagedIngressAnnotation = "pigo.io/managed-ingress"
+	// LastReconcileAnnotation is the time the bot last changed the status.
+	LastReconcileAnnotation = "pigo.io/last-reconcile"
+)
+
+var statusAnnotations = []string{URLAnnotation, ManagedServiceAnnotation, ManagedIngressAnnotation, LastReconcileAnnotation}
+
+// WorkloadListers list the workloads from the caches of the informers, the
+// status is written on them.
+type WorkloadListers struct {
+	Deployments  appslisters.DeploymentLister
+	StatefulSets appslisters.StatefulSetLister
+	DaemonSets   appslisters.DaemonSetLister
+}
+
+// NewWorkloadListers returns the listers of the workloads cached by
+// informerFactory.
+func NewWorkloadListers(informerFactory informers.SharedInformerFactory) *WorkloadListers {
+	return &WorkloadListers{
+		Deployments:  informerFactory.Apps().V1().Deployments().Lister(),
+		StatefulSets: informerFactory.Apps().V1().StatefulSets().Lister(),
+		DaemonSets:   informerFactory.Apps().V1().DaemonSets().Lister(),
+	}
+}
+
+// Annotations returns the annotations of the workload ref.
+func (l *WorkloadListers) Annotations(ref *v1.ObjectReference) (map[string]string, error) {
+	var obj metav1.Object
+	var err error
+	switch ref.Kind {
+	case "StatefulSet":
+		obj, err = l.StatefulSets.StatefulSets(ref.Namespace).Get(ref.Name)
+	case "DaemonSet":
+		obj, err = l.DaemonSets.DaemonSets(ref.Namespace).Get(ref.Name)
+	default:
+		obj, err = l.Deployments.Deployments(ref.Namespace).Get(ref.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return obj.GetAnnotations(), nil
+}
+
+// PatchStatus sets the status annotations of the workload ref to status, an
+// empty value removes the annotation. current are the annotations of the
+// workload, it is only patched when status differs from them, and the time of
+// the patch is recorded in its last-reconcile annotation unless status sets
+// it. A workload which is gone has no status to patch.
+func PatchStatus(client kubernetes.Interface, ref *v1.ObjectReference, current, status map[string]string) (err error) {
+	annotations := map[string]interface{}{}
+	for k, v := range status {
+		cur, ok := current[k]
+		if v == "" && ok {
+			annotations[k] = nil
+		} else if v != "" && v != cur {
+			annotations[k] = v
+		}
+	}
+	if len(annotations) == 0 {
+		return nil
+	}
+	if _, ok := status[LastReconcileAnnotation]; !ok {
+		annotations[LastReconcileAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	data, err := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": annotations}})
+	if err != nil {
+		return err
+	}
+	switch ref.Kind {
+	case "StatefulSet":
+		_, err = client.AppsV1().StatefulSets(ref.Namespace).Patch(context.TODO(), ref.Name, types.MergePatchType, data, metav1.PatchOptions{})
+	case "DaemonSet":
+		_, err = client.AppsV1().DaemonSets(ref.Namespace).Patch(context.TODO(), ref.Name, types.MergePatchType, data, metav1.PatchOptions{})
+	default:
+		_, err = client.AppsV1().Deployments(ref.Namespace).Patch(context.TODO(), ref.Name, types.MergePatchType, data, metav1.PatchOptions{})
+	}
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("namespace", ref.Namespace).
+			Str("name", ref.Name).
+			Msgf("patch the status of the %s", ref.Kind)
+	}
+
+	return
+}
+
+// ClearStatus removes the status annotations of the workload w the bot no
+// longer manages.
+func (s *Service) ClearStatus(w *Workload) error {
+	status := map[string]string{}
+	for _, k := range statusAnnotations {
+		status[k] = ""
+	}
+
+	return PatchStatus(s.K8sClient, w.objectReference(), w.Annotations, status)
+}
+
+// patchStatus records the service of the workload w in its annotations, or
+// removes it when the bot manages no service for w.
+func (s *Service) patchStatus(w *Workload, desired *v1.Service, managed bool) error {
+	// The governing service of a statefulset is not the one of the workload
+	if desired.Name != s.Config.ServiceName(w.Name) {
+		return nil
+	}
+	sn := ""
+	if managed {
+		sn = desired.Name
+	}
+
+	return PatchStatus(s.K8sClient, w.objectReference(), w.Annotations, map[string]string{ManagedServiceAnnotation: sn})
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// A Workload runs the pods the services of the bot route to, it is built
+// from a deployment, a statefulset or a daemonset.
+type Workload struct {
+	metav1.ObjectMeta
+	// Kind is the kind of the workload, Deployment, StatefulSet or DaemonSet.
+	Kind string
+	Template v1.PodTemplateSpec
+	// ReadyReplicas is the number of replicas able to serve.
+	ReadyReplicas int32
+}
+
+// DeploymentWorkload returns the workload of the deployment d.
+func DeploymentWorkload(d *appsv1.Deployment) *Workload {
+	return &Workload{
+		ObjectMeta: d.ObjectMeta,
+		Kind: "Deployment",
+		Template: d.Spec.Template,
+		ReadyReplicas: d.Status.AvailableReplicas,
+	}
+}
+
+// StatefulSetWorkload returns the workload of the statefulset s.
+func StatefulSetWorkload(s *appsv1.StatefulSet) *Workload {
+	return &Workload{
+		ObjectMeta: s.ObjectMeta,
+		Kind: "StatefulSet",
+		Template: s.Spec.Template,
+		ReadyReplicas: s.Status.ReadyReplicas,
+	}
+}
+
+// DaemonSetWorkload returns the workload of the daemonset ds.
+func DaemonSetWorkload(ds *appsv1.DaemonSet) *Workload {
+	return &Workload{
+		ObjectMeta: ds.ObjectMeta,
+		Kind: "DaemonSet",
+		Template: ds.Spec.Template,
+		ReadyReplicas: ds.Status.NumberAvailable,
+	}
+}
+
+// ownerReference returns the controller reference of the services of w.
+func (w *Workload) ownerReference() *metav1.OwnerReference {
+	return metav1.NewControllerRef(w, appsv1.SchemeGroupVersion.WithKind(w.Kind))
+}
+
+// objectReference returns the reference the events about w are recorded on.
+func (w *Workload) objectReference() *v1.ObjectReference {
+	return &v1.ObjectReference{
+		APIVersion: appsv1.SchemeGroupVersion.String(),
+		Kind:       w.Kind,
+		Namespace:  w.Namespace,
+		Name:       w.Name,
+		UID:        w.UID,
+	}
+}